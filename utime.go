@@ -10,272 +10,2092 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-const rfc2822 = "Mon, _2 Jan 2006 15:04:05 -0700"
+const (
+	rfc2822 = "Mon, _2 Jan 2006 15:04:05 -0700"
+
+	exitPartial = 3
+)
 
 var (
 	stdout io.Writer = os.Stdout
 	stderr io.Writer = os.Stderr
+	stdin  io.Reader = os.Stdin
+	outMu  sync.Mutex
 
-	diffMerges = "--no-merges"
-	recurse    = flag.Bool("r", false, "Recurse into submodules.")
-	errParse   = errors.New("parse error")
+	opts = &options{
+		diffMerges: "--no-merges",
+		dateSource: "committer",
+		dirTime:    "contents",
+		dirtyDirs:  "keep",
+		outside:    "skip",
+		fallback:   "oldest",
+		refresh:    true,
+	}
+	jsonOutput    = flag.Bool("json", false, "Report failures in JSON to stdout, and write progress to stderr.")
+	timeout       = flag.Duration("timeout", 0, "Abort after the specified duration.")
+	jobs          = flag.Int("j", runtime.NumCPU(), "Number of repositories or submodules to process in parallel.")
+	nulTerminated = flag.Bool("z", false, "Terminate each line of show with NUL.")
+	format        = flag.String("format", "%H %mI\t%p", "Format each line of show with the specified `format` (%H, %h, %mI, %cI, %aI and %p).")
+	reposFrom     = flag.String("repos-from", "", "Read NUL separated repository paths from the specified file (- for stdin).")
+	errParse      = errors.New("parse error")
 )
 
 func init() {
-	flag.Var(newMergeValue(&diffMerges, "-c"), "c", `Specify the -c option to git log.`)
-	flag.Var(newMergeValue(&diffMerges, "-m"), "m", `Specify the -m option to git log.`)
+	opts.register(flag.CommandLine)
+}
+
+// options represents the flags which can differ for each repository. The
+// command line values are in opts.
+type options struct {
+	diffMerges        string
+	dateSource        string
+	dirTime           string
+	dirtyDirs         string
+	outside           string
+	fallback          string
+	recurse           bool
+	modules           listValue
+	submoduleExcludes listValue
+	fileExcludes      listValue
+	ignoreAuthors     listValue
+	ignoreCommitters  listValue
+	ignoreMessages    listValue
+	ignoreRevsFiles   listValue
+	maxFiles          int
+	ignoreModes       bool
+	ignoreWhitespace  bool
+	byContent         bool
+	allRefs           bool
+	since             string
+	until             string
+	maxCount          int
+	clamp             bool
+	skipOutOfSync     bool
+	here              bool
+	refresh           bool
+	keepGoing         bool
+	revision          string
+}
+
+// register defines the flags for the options in fs. Their default values are
+// the current values of the options.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.Var(newMergeValue(&o.diffMerges, "-c"), "c", `Specify the -c option to git log.`)
+	fs.Var(newMergeValue(&o.diffMerges, "-m"), "m", `Specify the -m option to git log.`)
+	fs.Var(newChoiceValue(&o.dateSource, "committer", "author"), "date-source", "Date files by the committer date or the author date.")
+	fs.Var(newChoiceValue(&o.dirTime, "contents", "entries"), "dir-time", "Date directories by the changes of their contents or entries.")
+	fs.Var(newChoiceValue(&o.dirtyDirs, "keep", "latest"), "dirty-dirs", "Keep the modification time of directories which have modified or untracked entries, or set it to the latest one of them.")
+	fs.Var(newChoiceValue(&o.outside, "skip", "clamp"), "outside", "Leave files changed outside of -since and -until alone, or clamp them to the limits.")
+	fs.Var(newChoiceValue(&o.fallback, "oldest", "none"), "fallback", "Date files which are not resolved within -max-count by the oldest commit seen, or leave them alone.")
+	fs.BoolVar(&o.recurse, "r", o.recurse, "Recurse into submodules.")
+	fs.Var(&o.modules, "submodule", "Process only the specified submodule (path or name). Implies -r.")
+	fs.Var(&o.submoduleExcludes, "exclude-submodule", "Do not process submodules which match the specified pattern.")
+	fs.Var(&o.fileExcludes, "exclude", "Do not update files which match the specified `glob`.")
+	fs.Var(&o.ignoreAuthors, "ignore-author", "Ignore commits whose author matches the specified `regex`.")
+	fs.Var(&o.ignoreCommitters, "ignore-committer", "Ignore commits whose committer matches the specified `regex`.")
+	fs.Var(&o.ignoreMessages, "ignore-message", "Ignore commits whose message matches the specified `regex`.")
+	fs.Var(&o.ignoreRevsFiles, "ignore-revs-file", "Ignore commits listed in the specified `file`. Defaults to blame.ignoreRevsFile.")
+	fs.IntVar(&o.maxFiles, "max-files-per-commit", o.maxFiles, "Ignore commits which change more than `N` files.")
+	fs.BoolVar(&o.ignoreModes, "ignore-mode-changes", o.ignoreModes, "Ignore changes of the file mode.")
+	fs.BoolVar(&o.ignoreWhitespace, "ignore-whitespace", o.ignoreWhitespace, "Ignore whitespace changes.")
+	fs.BoolVar(&o.byContent, "by-content", o.byContent, "Date files by the oldest commit which introduced their current content.")
+	fs.BoolVar(&o.allRefs, "all-refs", o.allRefs, "Search all refs for the oldest commit which introduced the current content. Implies -by-content.")
+	fs.StringVar(&o.since, "since", o.since, "Update only files changed since the specified `date`.")
+	fs.StringVar(&o.until, "until", o.until, "Update only files changed until the specified `date`.")
+	fs.IntVar(&o.maxCount, "max-count", o.maxCount, "Stop walking the history after `N` commits.")
+	fs.BoolVar(&o.clamp, "submodule-clamp", o.clamp, "Clamp the modification time of files in submodules to the commit date of the superproject.")
+	fs.BoolVar(&o.skipOutOfSync, "skip-out-of-sync", o.skipOutOfSync, "Skip submodules whose checked out commit does not match the index.")
+	fs.BoolVar(&o.here, "here", o.here, "Limit to the current directory.")
+	fs.BoolVar(&o.refresh, "refresh", o.refresh, "Refresh the index after updating.")
+	fs.BoolVar(&o.keepGoing, "k", o.keepGoing, "Keep going when the modification time cannot be updated.")
+	fs.StringVar(&o.revision, "rev", o.revision, "Resolve the modification times from the specified `revision` instead of HEAD.")
 }
 
 func main() {
 	flag.Parse()
+	var cmd string
+	var args []string
+	switch flag.Arg(0) {
+	case "explain", "show":
+		cmd = flag.Arg(0)
+		// flags can also be specified after the command
+		args, _ = parseArgs(flag.CommandLine, flag.Args()[1:])
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func(ctx context.Context) {
+		<-ctx.Done()
+		// a second signal terminates the process
+		stop()
+	}(ctx)
+	if err := config(ctx, ".", globals()); err != nil {
+		abort(err)
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	switch cmd {
+	case "explain":
+		if err := explain(ctx, args); err != nil {
+			abort(err)
+		}
+		return
+	case "show":
+		if err := show(ctx, args); err != nil {
+			abort(err)
+		}
+		return
+	}
+
+	repos := flag.Args()
+	if *reposFrom != "" {
+		list, err := readRepos(*reposFrom)
+		if err != nil {
+			abort(err)
+		}
+		repos = append(repos, list...)
+	}
+	if len(repos) == 0 {
+		repos = append(repos, ".")
+	}
+	if len(repos) == 1 {
+		if err := run(ctx, repos[0], ""); err != nil {
+			var fails failures
+			if errors.As(err, &fails) {
+				report(fails)
+				os.Exit(exitPartial)
+			}
+			abort(err)
+		}
+		return
+	}
+	os.Exit(runAll(ctx, repos))
+}
+
+// parseArgs parses the flags which are interleaved with the arguments, and
+// returns the arguments. The arguments after "--" are not parsed.
+func parseArgs(fs *flag.FlagSet, args []string) (list []string, err error) {
+	for len(args) > 0 {
+		if err = fs.Parse(args); err != nil {
+			return
+		}
+		if n := len(args) - fs.NArg(); n > 0 && args[n-1] == "--" {
+			list = append(list, fs.Args()...)
+			break
+		}
+		if args = fs.Args(); len(args) > 0 {
+			list = append(list, args[0])
+			args = args[1:]
+		}
+	}
+	return
+}
+
+func readRepos(name string) (repos []string, err error) {
+	var b []byte
+	if name == "-" {
+		b, err = io.ReadAll(stdin)
+	} else {
+		b, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return
+	}
+	for p := range strings.SplitSeq(string(b), "\x00") {
+		if p != "" {
+			repos = append(repos, p)
+		}
+	}
+	return
+}
+
+func run(ctx context.Context, path, label string) error {
+	if label != "" {
+		ctx = withLabel(ctx, label)
+	}
+	release := acquire()
+	wt, err := getwt(ctx, path)
+	var o *options
+	if err == nil {
+		o, err = repoOptions(ctx, wt)
+	}
+	var prefix string
+	if err == nil && o.here {
+		prefix, err = revParse(ctx, path, "--show-prefix")
+	}
+	release()
+	if err != nil {
+		return err
+	}
+	return utimeAll(ctx, o, wt, prefix, label)
+}
+
+// limiter limits the number of repositories and submodules which are
+// processed in parallel.
+var limiter = sync.OnceValue(func() chan struct{} {
+	return make(chan struct{}, max(*jobs, 1))
+})
+
+// acquire blocks until a job can be started. A job must not acquire another
+// one before releasing it.
+func acquire() (release func()) {
+	sem := limiter()
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+func runAll(ctx context.Context, repos []string) (rc int) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var fails failures
+	for _, p := range repos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := run(ctx, p, p)
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+
+			var fe failures
+			if errors.As(err, &fe) {
+				fails = append(fails, fe...)
+				if rc == 0 {
+					rc = exitPartial
+				}
+				return
+			}
+			outMu.Lock()
+			fmt.Fprintf(stderr, "error: %v: %v\n", p, err)
+			outMu.Unlock()
+			rc = 1
+		}()
+	}
+	wg.Wait()
+
+	if len(fails) > 0 {
+		report(fails)
+	}
+	return
+}
+
+// configNames maps the names of git config variables to the flags whose
+// names differ from them.
+var configNames = map[string]string{
+	"recurse":   "r",
+	"keepgoing": "k",
+	"jobs":      "j",
+}
+
+// config sets the default values of the flags in fs from the utime section
+// of git config. The flags specified on the command line take precedence.
+func config(ctx context.Context, path string, fs *flag.FlagSet) error {
+	vars, err := gitConfig(ctx, path, "--get-regexp", `^utime\.`)
+	if err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	flags := make(map[string]*flag.Flag)
+	fs.VisitAll(func(f *flag.Flag) { flags[strings.ReplaceAll(strings.ToLower(f.Name), "-", "")] = f })
+	for _, v := range vars {
+		name := strings.TrimPrefix(v.key, "utime.")
+		if name == "merges" {
+			if set["c"] || set["m"] || flags["c"] == nil {
+				continue
+			}
+			switch v.value {
+			case "none":
+				fs.Set("c", "false")
+				fs.Set("m", "false")
+			case "c", "m":
+				fs.Set(v.value, "true")
+			default:
+				return fmt.Errorf("%v: invalid value: %v", v.key, v.value)
+			}
+			continue
+		}
+		if n, ok := configNames[name]; ok {
+			name = n
+		}
+		f, ok := flags[name]
+		if !ok || set[f.Name] {
+			continue
+		}
+		if isBoolFlag(f) {
+			switch strings.ToLower(v.value) {
+			case "yes", "on":
+				v.value = "true"
+			case "no", "off", "":
+				v.value = "false"
+			}
+		}
+		if err := f.Value.Set(v.value); err != nil {
+			return fmt.Errorf("%v: invalid value: %v", v.key, v.value)
+		}
+	}
+	return nil
+}
+
+// globals returns the flags which are shared by the repositories. Their
+// default values are read from git config of the current directory.
+func globals() *flag.FlagSet {
+	repo := flag.NewFlagSet("", flag.ContinueOnError)
+	new(options).register(repo)
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		if repo.Lookup(f.Name) == nil {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	return fs
+}
+
+// repoOptions returns the options for the repository. The flags which are not
+// specified on the command line are read from git config of the repository.
+func repoOptions(ctx context.Context, path string) (*options, error) {
+	o := *opts
+	for _, l := range []*listValue{&o.modules, &o.submoduleExcludes, &o.fileExcludes, &o.ignoreAuthors, &o.ignoreCommitters, &o.ignoreMessages, &o.ignoreRevsFiles} {
+		*l = slices.Clone(*l)
+	}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	o.register(fs)
+	if err := config(ctx, path, fs); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// explain shows how the modification times of the paths are resolved.
+func explain(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("no paths specified")
+	}
+	wt, err := getwt(ctx, ".")
+	if err != nil {
+		return err
+	}
+	o, err := repoOptions(ctx, wt)
+	if err != nil {
+		return err
+	}
+	prefix, err := revParse(ctx, ".", "--show-prefix")
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, a := range args {
+		p := path.Join(prefix, filepath.ToSlash(a))
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("%v: outside repository", a)
+		}
+		paths = append(paths, p)
+	}
+
+	t := &tree{
+		wt:    wt,
+		trace: true,
+	}
+	if t.files, t.dirty, err = ls(ctx, o, wt, "", paths...); err != nil {
+		return err
+	}
+	if t.attrs, err = checkAttr(ctx, wt, t.files); err != nil {
+		return err
+	}
+	files := maps.Clone(t.files)
+	// progress is never shown
+	r, err := resolve(ctx, o, t, &progress{label: "explain", n: len(t.files)})
+	if err != nil {
+		return err
+	}
+	dirs, from := dirTimes(o, t, r)
+
+	merges := o.diffMerges
+	if merges == "--no-merges" {
+		merges = "none"
+	}
+	fmt.Fprintf(stdout, "merges:  %v\n", merges)
+	fmt.Fprintf(stdout, "date:    %v\n", o.dateSource)
+	// flags which differ from their default values
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	o.register(fs)
+	var flags []string
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if g := fs.Lookup(f.Name); g != nil {
+			// read from git config of the repository
+			v = g.Value.String()
+		}
+		switch {
+		case v == f.DefValue:
+		case v == "true" && isBoolFlag(f):
+			flags = append(flags, "-"+f.Name)
+		default:
+			flags = append(flags, fmt.Sprintf("-%v=%v", f.Name, v))
+		}
+	})
+	if len(flags) > 0 {
+		fmt.Fprintf(stdout, "flags:   %v\n", strings.Join(flags, " "))
+	}
+	for _, p := range paths {
+		fmt.Fprintln(stdout)
+		fmt.Fprintln(stdout, p)
+		if c, ok := r.files[p]; ok {
+			if c.hash != "" {
+				fmt.Fprintf(stdout, "    commit:    %v\n", c.hash)
+				fmt.Fprintf(stdout, "    author:    %v\n", c.author.Format(rfc2822))
+				fmt.Fprintf(stdout, "    committer: %v\n", c.committer.Format(rfc2822))
+			}
+			if v, ok := t.attrs[p]; ok {
+				fmt.Fprintf(stdout, "    attribute: utime=%v\n", v)
+			}
+			fmt.Fprintf(stdout, "    mtime:     %v\n", t.at(c.time).Format(rfc2822))
+			if s, ok := r.notes[p]; ok {
+				fmt.Fprintf(stdout, "    note:      %v\n", s)
+			}
+			for _, sk := range r.skipped[p] {
+				fmt.Fprintf(stdout, "    skipped:   %v (%v)\n", sk.hash, sk.reason)
+			}
+			continue
+		}
+		if tm, ok := dirs[p]; ok {
+			switch f, ok := from[p]; {
+			case ok:
+				fmt.Fprintf(stdout, "    child:     %v\n", f)
+			case r.entries[p] != nil:
+				fmt.Fprintf(stdout, "    commit:    %v (entries changed)\n", r.entries[p].hash)
+			}
+			fmt.Fprintf(stdout, "    mtime:     %v\n", tm.Format(rfc2822))
+			continue
+		}
+		reason := "not tracked or excluded"
+		switch _, ok := files[p]; {
+		case r.notes[p] != "":
+			reason = r.notes[p]
+		case ok:
+			reason = "not found in the history"
+		case t.attrs[p] == "skip":
+			reason = "utime=skip"
+		default:
+			for d := range t.dirty {
+				switch {
+				case d == p:
+					reason = "modified or untracked"
+				case p == "." || strings.HasPrefix(d, p+"/"):
+					reason = "has modified or untracked entries"
+				default:
+					continue
+				}
+				break
+			}
+		}
+		fmt.Fprintf(stdout, "    not updated: %v\n", reason)
+		for _, sk := range r.skipped[p] {
+			fmt.Fprintf(stdout, "    skipped:   %v (%v)\n", sk.hash, sk.reason)
+		}
+	}
+	return nil
+}
+
+// show prints the resolved modification times of the files in the revision
+// without updating them.
+func show(ctx context.Context, args []string) error {
+	bare, err := revParse(ctx, ".", "--is-bare-repository")
+	if err != nil {
+		return err
+	}
+	o, err := repoOptions(ctx, ".")
+	if err != nil {
+		return err
+	}
+	wt := "."
+	var prefix string
+	if bare != "true" {
+		if wt, err = getwt(ctx, "."); err != nil {
+			return err
+		}
+		if prefix, err = revParse(ctx, ".", "--show-prefix"); err != nil {
+			return err
+		}
+	}
+	t := &tree{
+		wt:  wt,
+		rev: o.revision,
+	}
+	for _, a := range args {
+		t.paths = append(t.paths, path.Join(prefix, filepath.ToSlash(a)))
+	}
+	if len(t.paths) == 0 && prefix != "" {
+		// same as git ls-tree
+		t.paths = []string{prefix}
+	}
+	if t.rev == "" {
+		t.rev = "HEAD"
+	}
+	blobs, err := lsTree(ctx, wt, t.rev, t.paths...)
+	if err != nil {
+		return err
+	}
+	t.files = make(fileset)
+	for f := range blobs {
+		t.files[f] = struct{}{}
+	}
+	if t.attrs, err = checkAttr(ctx, wt, t.files); err != nil {
+		return err
+	}
+	// progress is never shown
+	r, err := resolve(ctx, o, t, &progress{label: "show", n: len(t.files)})
+	if err != nil {
+		return err
+	}
+
+	var abbrev map[string]string
+	if strings.Contains(*format, "%h") {
+		if abbrev, err = abbrevCommits(ctx, wt, r.files); err != nil {
+			return err
+		}
+	}
+	eol := "\n"
+	if *nulTerminated {
+		eol = "\x00"
+	}
+	bw := bufio.NewWriter(stdout)
+	for _, f := range slices.Sorted(maps.Keys(r.files)) {
+		c := r.files[f]
+		var b strings.Builder
+		for s := *format; s != ""; {
+			i := strings.IndexByte(s, '%')
+			if i == -1 {
+				b.WriteString(s)
+				break
+			}
+			b.WriteString(s[:i])
+			s = s[i:]
+			switch {
+			case strings.HasPrefix(s, "%H"):
+				b.WriteString(c.hash)
+				s = s[2:]
+			case strings.HasPrefix(s, "%h"):
+				b.WriteString(abbrev[c.hash])
+				s = s[2:]
+			case strings.HasPrefix(s, "%mI"):
+				// the modification time to be applied
+				b.WriteString(t.at(c.time).Format(time.RFC3339))
+				s = s[3:]
+			case strings.HasPrefix(s, "%cI"):
+				b.WriteString(isoTime(c.committer))
+				s = s[3:]
+			case strings.HasPrefix(s, "%aI"):
+				b.WriteString(isoTime(c.author))
+				s = s[3:]
+			case strings.HasPrefix(s, "%p"):
+				b.WriteString(f)
+				s = s[2:]
+			case strings.HasPrefix(s, "%%"):
+				b.WriteByte('%')
+				s = s[2:]
+			default:
+				b.WriteByte('%')
+				s = s[1:]
+			}
+		}
+		bw.WriteString(b.String() + eol)
+	}
+	return bw.Flush()
+}
+
+// isoTime formats the time in the strict ISO 8601 format. The zero time, which
+// does not come from a commit, is formatted as an empty string.
+func isoTime(tm time.Time) string {
+	if tm.IsZero() {
+		return ""
+	}
+	return tm.Format(time.RFC3339)
+}
+
+// abbrevCommits returns the abbreviated names of the resolved commits.
+func abbrevCommits(ctx context.Context, wt string, files map[string]*logEntry) (map[string]string, error) {
+	abbrev := make(map[string]string)
+	var b strings.Builder
+	for _, c := range files {
+		if _, ok := abbrev[c.hash]; !ok && c.hash != "" {
+			abbrev[c.hash] = ""
+			b.WriteString(c.hash + "\n")
+		}
+	}
+	if len(abbrev) == 0 {
+		return abbrev, nil
+	}
+	err := gitInput(ctx, []string{"-C", wt, "log", "--no-walk=unsorted", "--stdin", "--pretty=%H %h"}, strings.NewReader(b.String()), func(out *bufio.Reader) error {
+		for {
+			s, err := out.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			h, a, _ := strings.Cut(strings.TrimRight(s, "\r\n"), " ")
+			abbrev[h] = a
+		}
+	})
+	return abbrev, err
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+type mergeValue struct {
+	s       *string
+	on, off string
+}
+
+func newMergeValue(p *string, v string) *mergeValue {
+	return &mergeValue{
+		s:   p,
+		on:  v,
+		off: *p,
+	}
+}
+
+func (m *mergeValue) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	switch {
+	case err != nil:
+		err = errParse
+	case v:
+		*m.s = m.on
+	case *m.s == m.on:
+		*m.s = m.off
+	}
+	return err
+}
+
+func (m *mergeValue) Get() any         { return m.s != nil && *m.s == m.on }
+func (m *mergeValue) String() string   { return strconv.FormatBool(m.s != nil && *m.s == m.on) }
+func (m *mergeValue) IsBoolFlag() bool { return true }
+
+type choiceValue struct {
+	s       *string
+	choices []string
+}
+
+func newChoiceValue(p *string, choices ...string) *choiceValue {
+	return &choiceValue{
+		s:       p,
+		choices: choices,
+	}
+}
+
+func (c *choiceValue) Set(s string) error {
+	if !slices.Contains(c.choices, s) {
+		return errParse
+	}
+	*c.s = s
+	return nil
+}
+
+func (c *choiceValue) Get() any { return c.String() }
+
+func (c *choiceValue) String() string {
+	if c.s == nil {
+		return ""
+	}
+	return *c.s
+}
+
+type listValue []string
+
+func (l *listValue) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *listValue) Get() any       { return []string(*l) }
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func warn(ctx context.Context, format string, a ...any) {
+	outMu.Lock()
+	defer outMu.Unlock()
+
+	fmt.Fprintf(stderr, "%vwarning: "+format+"\n", append([]any{labelOf(ctx)}, a...)...)
+}
+
+type labelKey struct{}
+
+// withLabel returns the context whose warnings and error output of git are
+// labeled with the repository.
+func withLabel(ctx context.Context, label string) context.Context {
+	return context.WithValue(ctx, labelKey{}, label)
+}
+
+// labelOf returns the prefix for the label of the context.
+func labelOf(ctx context.Context) string {
+	if label, _ := ctx.Value(labelKey{}).(string); label != "" {
+		return label + ": "
+	}
+	return ""
+}
+
+// labelWriter prefixes each line with the label.
+type labelWriter struct {
+	w     io.Writer
+	label string
+	buf   []byte
+}
+
+func (lw *labelWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i == -1 {
+			break
+		}
+		lw.write(lw.buf[:i+1])
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close writes the incomplete line.
+func (lw *labelWriter) Close() error {
+	if len(lw.buf) > 0 {
+		lw.write(append(lw.buf, '\n'))
+		lw.buf = nil
+	}
+	return nil
+}
+
+func (lw *labelWriter) write(l []byte) {
+	outMu.Lock()
+	defer outMu.Unlock()
 
-	wt, err := getwt()
+	fmt.Fprintf(lw.w, "%v%s", lw.label, l)
+}
+
+func abort(err error) {
+	if err, ok := err.(*exec.ExitError); ok {
+		os.Exit(err.ExitCode())
+	}
+	fmt.Fprintln(stderr, "error:", err)
+	os.Exit(1)
+}
+
+func report(fails failures) {
+	if *jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(fails)
+		return
+	}
+	for _, f := range fails {
+		fmt.Fprintf(stderr, "error: %v: %v\n", f.Path, f.Err)
+	}
+}
+
+type failure struct {
+	Path  string `json:"path"`
+	Errno int    `json:"errno"`
+	Err   string `json:"error"`
+}
+
+type failures []failure
+
+func (f *failures) add(path string, err error) {
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	*f = append(*f, failure{
+		Path:  path,
+		Errno: int(errno),
+		Err:   err.Error(),
+	})
+}
+
+func (f failures) Error() string { return fmt.Sprintf("%d file(s) could not be updated", len(f)) }
+
+type fileset map[string]struct{}
+
+func getwt(ctx context.Context, path string) (string, error) {
+	wt, err := revParse(ctx, path, "--show-toplevel")
+	return filepath.FromSlash(wt), err
+}
+
+func revParse(ctx context.Context, path, opt string) (s string, err error) {
+	err = git(ctx, []string{"-C", path, "rev-parse", opt}, func(out *bufio.Reader) error {
+		s, err = out.ReadString('\n')
+		if err == nil {
+			s = strings.TrimRight(s, "\r\n")
+		}
+		return err
+	})
+	return
+}
+
+func utimeAll(ctx context.Context, o *options, wt, prefix, label string) error {
+	pg := &progress{label: label}
+	release := acquire()
+	order, trees, deps, err := plan(ctx, o, wt, prefix, pg)
+	release()
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("%w (while listing files, %d files listed)", ctx.Err(), pg.n)
+	case err != nil:
+		return err
+	}
+	defer pg.done()
+
+	done := make(map[string]chan struct{}, len(order))
+	for _, p := range order {
+		done[p] = make(chan struct{})
+	}
+
+	gctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var fails failures
+	var first error
+	for _, p := range order {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[p])
+			for _, q := range deps[p] {
+				<-done[q]
+			}
+			if gctx.Err() != nil {
+				return
+			}
+			release := acquire()
+			defer release()
+
+			t := trees[p]
+			err := utime(gctx, o, t, pg)
+			if _, ok := err.(failures); err == nil || ok {
+				// files which are not found in the history
+				pg.skip(len(t.files))
+				if o.refresh && len(t.applied) > 0 {
+					if rerr := refreshIndex(gctx, p, t.applied); rerr != nil {
+						err = rerr
+					}
+				}
+			}
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch fe, ok := err.(failures); {
+			case ok:
+				fails = append(fails, fe...)
+			case first == nil:
+				first = err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("%w (%d/%d files processed)", ctx.Err(), pg.m, pg.n)
+	case first != nil:
+		return first
+	case len(fails) > 0:
+		sort.Slice(fails, func(i, j int) bool { return fails[i].Path < fails[j].Path })
+		return fails
+	}
+	return nil
+}
+
+// plan lists the trees of the worktree and its submodules, and the
+// submodules which have to be processed before each tree.
+func plan(ctx context.Context, o *options, wt, prefix string, pg *progress) (order []string, trees map[string]*tree, deps map[string][]string, err error) {
+	order = []string{wt}
+	if o.recurse || len(o.modules) > 0 {
+		var mods []string
+		if mods, err = submodules(ctx, o, wt, pathspec(prefix)...); err != nil {
+			return
+		}
+		order = append(order, mods...)
+	}
+	trees = make(map[string]*tree, len(order))
+	for _, p := range order {
+		t := &tree{wt: p}
+		if p == wt {
+			t.prefix = prefix
+			t.rev = o.revision
+		}
+		if t.files, t.dirty, err = ls(ctx, o, p, t.rev, pathspec(t.prefix)...); err != nil {
+			return
+		}
+		if t.attrs, err = checkAttr(ctx, p, t.files); err != nil {
+			return
+		}
+		trees[p] = t
+		pg.n += len(t.files)
+	}
+
+	// submodules have to be processed before their superproject
+	deps = make(map[string][]string)
+	for i, p := range order[1:] {
+		super := wt
+		for _, q := range order[1 : i+1] {
+			if strings.HasPrefix(p, q+string(filepath.Separator)) && len(q) > len(super) {
+				super = q
+			}
+		}
+		deps[super] = append(deps[super], p)
+		if o.clamp {
+			rel, _ := filepath.Rel(super, p)
+			var tm time.Time
+			if tm, err = lastCommit(ctx, o, super, filepath.ToSlash(rel)); err != nil {
+				return
+			}
+			if lim := trees[super].limit; !lim.IsZero() && (tm.IsZero() || lim.Before(tm)) {
+				tm = lim
+			}
+			trees[p].limit = tm
+		}
+	}
+	return
+}
+
+func pathspec(prefix string) []string {
+	if prefix == "" {
+		return nil
+	}
+	return []string{prefix}
+}
+
+type progress struct {
+	mu     sync.Mutex
+	label  string
+	m, n   int
+	approx int // files resolved approximately
+	shown  bool
+}
+
+func (pg *progress) skip(n int) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.m += n
+}
+
+// out returns the writer for the progress. Stdout is reserved for the report
+// if -json is specified.
+func (pg *progress) out() io.Writer {
+	if *jsonOutput {
+		return stderr
+	}
+	return stdout
+}
+
+func (pg *progress) inc() {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.m++
+	if pg.label == "" {
+		fmt.Fprintf(pg.out(), "\rutime: %3d%% (%d/%d)", pg.m*100/pg.n, pg.m, pg.n)
+		pg.shown = true
+	}
+}
+
+func (pg *progress) fallback() {
+	pg.inc()
+
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+
+	pg.approx++
+}
+
+func (pg *progress) done() {
+	switch {
+	case pg.label != "":
+		// labeled progress is reported only once
+		if pg.n > 0 {
+			outMu.Lock()
+			fmt.Fprintf(pg.out(), "%v: utime: %3d%% (%d/%d)\n", pg.label, pg.m*100/pg.n, pg.m, pg.n)
+			outMu.Unlock()
+		}
+	case pg.shown:
+		fmt.Fprintln(pg.out())
+	}
+	if pg.approx > 0 {
+		var label string
+		if pg.label != "" {
+			label = pg.label + ": "
+		}
+		outMu.Lock()
+		fmt.Fprintf(pg.out(), "%vutime: %d file(s) resolved approximately\n", label, pg.approx)
+		outMu.Unlock()
+	}
+}
+
+func submodules(ctx context.Context, o *options, wt string, pathspec ...string) (mods []string, err error) {
+	var walk func(string, string, []string) error
+	walk = func(dir, display string, pathspec []string) error {
+		names, err := gitConfig(ctx, dir, "-f", ".gitmodules", "--get-regexp", `^submodule\..*\.path$`)
+		if err != nil {
+			return err
+		}
+		paths := make(map[string]string)
+		for _, v := range names {
+			paths[v.value] = strings.TrimSuffix(strings.TrimPrefix(v.key, "submodule."), ".path")
+		}
+		type entry struct {
+			c byte
+			p string
+		}
+		var list []entry
+		err = git(ctx, append([]string{"-C", dir, "submodule", "status", "--"}, pathspec...), func(out *bufio.Reader) error {
+			for {
+				s, err := out.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				c, p := parseStatus(strings.TrimRight(s, "\r\n"), paths)
+				list = append(list, entry{c, p})
+			}
+		})
+		if err != nil || len(list) == 0 {
+			return err
+		}
+		// git config takes precedence over .gitmodules
+		utime := make(map[string]string)
+		for _, args := range [][]string{
+			{"-f", ".gitmodules", "--type=bool", "--get-regexp", `^submodule\..*\.utime$`},
+			{"--type=bool", "--get-regexp", `^submodule\..*\.utime$`},
+		} {
+			vars, err := gitConfig(ctx, dir, args...)
+			if err != nil {
+				return err
+			}
+			for _, v := range vars {
+				utime[v.key] = v.value
+			}
+		}
+
+		for _, e := range list {
+			name := paths[e.p]
+			p := path.Join(display, e.p)
+			switch e.c {
+			case '-':
+				// not initialized
+				continue
+			case '+':
+				if o.skipOutOfSync {
+					warn(ctx, "skip submodule '%v': checked out commit does not match the index", p)
+					continue
+				}
+				warn(ctx, "submodule '%v': checked out commit does not match the index", p)
+			case 'U':
+				warn(ctx, "skip submodule '%v': merge conflicts", p)
+				continue
+			}
+			if utime["submodule."+name+".utime"] == "false" || o.excludedSubmodule(p, name) {
+				continue
+			}
+			if o.selected(p, name) {
+				mods = append(mods, filepath.Join(wt, filepath.FromSlash(p)))
+			}
+			if err := walk(filepath.Join(wt, filepath.FromSlash(p)), p, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(wt, "", pathspec)
+	return
+}
+
+// parseStatus parses a line of git submodule status. A path is followed by
+// the output of git describe, so it is looked up from the paths in
+// .gitmodules.
+func parseStatus(s string, paths map[string]string) (c byte, p string) {
+	c = s[0]
+	_, s, _ = strings.Cut(s[1:], " ")
+	for k := range paths {
+		if (s == k || strings.HasPrefix(s, k+" (")) && len(k) > len(p) {
+			p = k
+		}
+	}
+	if p == "" {
+		p = s
+		if strings.HasSuffix(s, ")") {
+			if i := strings.LastIndex(s, " ("); i != -1 {
+				p = s[:i]
+			}
+		}
+	}
+	return
+}
+
+func (o *options) excludedSubmodule(p, name string) bool {
+	for _, pat := range o.submoduleExcludes {
+		for _, s := range []string{p, name} {
+			if ok, _ := path.Match(pat, s); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o *options) selected(p, name string) bool {
+	if len(o.modules) == 0 {
+		return true
+	}
+	for _, s := range o.modules {
+		s = strings.TrimSuffix(filepath.ToSlash(s), "/")
+		if s == p || s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func ls(ctx context.Context, o *options, path, rev string, pathspec ...string) (files, dirty fileset, err error) {
+	files = make(fileset)
+	if rev != "" {
+		blobs, err := lsTree(ctx, path, rev, pathspec...)
+		if err != nil {
+			return nil, nil, err
+		}
+		for f := range blobs {
+			files[f] = struct{}{}
+		}
+		// filter files which differ from the revision
+		err = git(ctx, append([]string{"-C", path, "diff", "--name-only", "-z", "--no-renames", rev, "--"}, pathspec...), func(out *bufio.Reader) error {
+			for {
+				p, err := out.ReadString('\x00')
+				if err != nil {
+					return err
+				}
+				delete(files, p[:len(p)-1])
+			}
+		})
+	} else {
+		err = git(ctx, append([]string{"-C", path, "ls-files", "-z", "--"}, pathspec...), func(out *bufio.Reader) error {
+			for {
+				p, err := out.ReadString('\x00')
+				if err != nil {
+					return err
+				}
+				files[p[:len(p)-1]] = struct{}{}
+			}
+		})
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// filter excluded
+	args := []string{"-C", path, "ls-files", "-z", "-c", "-i"}
+	n := len(args)
+	for _, pat := range o.fileExcludes {
+		args = append(args, "--exclude="+pat)
+	}
+	name := filepath.Join(path, ".utimeignore")
+	if fi, err := os.Stat(name); err == nil && !fi.IsDir() {
+		args = append(args, "--exclude-from="+name)
+	}
+	if len(args) > n {
+		err = git(ctx, append(append(args, "--"), pathspec...), func(out *bufio.Reader) error {
+			for {
+				p, err := out.ReadString('\x00')
+				if err != nil {
+					return err
+				}
+				delete(files, p[:len(p)-1])
+			}
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// filter modified
+	dirty = make(fileset)
+	// the index is refreshed only for the updated files
+	err = git(ctx, append([]string{"--no-optional-locks", "-C", path, "status", "-z", "--porcelain", "--"}, pathspec...), func(out *bufio.Reader) error {
+		for {
+			s, err := out.ReadString('\x00')
+			if err != nil {
+				return err
+			}
+			p := s[3 : len(s)-1]
+			delete(files, p)
+			dirty[strings.TrimSuffix(p, "/")] = struct{}{}
+			// renamed or copied
+			switch s[0] {
+			case 'R', 'C':
+				p, err := out.ReadString('\x00')
+				if err != nil {
+					return err
+				}
+				p = p[:len(p)-1]
+				delete(files, p)
+				dirty[p] = struct{}{}
+			}
+		}
+	})
+	return
+}
+
+// checkAttr returns the values of the utime attribute for the files. The files
+// which have utime=skip are removed from them.
+func checkAttr(ctx context.Context, path string, files fileset) (map[string]string, error) {
+	attrs := make(map[string]string)
+	if len(files) == 0 {
+		return attrs, nil
+	}
+	var b strings.Builder
+	for _, f := range slices.Sorted(maps.Keys(files)) {
+		b.WriteString(f)
+		b.WriteByte('\x00')
+	}
+	err := gitInput(ctx, []string{"-C", path, "check-attr", "-z", "--stdin", "utime"}, strings.NewReader(b.String()), func(out *bufio.Reader) error {
+		for {
+			// <path> NUL <attribute> NUL <info> NUL
+			var v [3]string
+			for i := range v {
+				s, err := out.ReadString('\x00')
+				if err != nil {
+					return err
+				}
+				v[i] = s[:len(s)-1]
+			}
+			switch v[2] {
+			case "skip":
+				delete(files, v[0])
+				fallthrough
+			case "author", "committer", "first-commit", "epoch":
+				attrs[v[0]] = v[2]
+			}
+		}
+	})
+	return attrs, err
+}
+
+// tree represents the files to be processed in a worktree.
+type tree struct {
+	wt      string
+	prefix  string
+	files   fileset
+	dirty   fileset           // modified or untracked paths
+	attrs   map[string]string // values of the utime attribute
+	limit   time.Time         // upper limit of the modification time
+	trace   bool              // record skipped commits
+	rev     string            // revision to resolve from instead of HEAD
+	paths   []string          // pathspec instead of the prefix
+	applied []string          // files whose modification time is updated
+}
+
+func (t *tree) pathspec() []string {
+	if t.paths != nil {
+		return t.paths
+	}
+	return pathspec(t.prefix)
+}
+
+// at returns the modification time clamped to the limit.
+func (t *tree) at(tm time.Time) time.Time {
+	if !t.limit.IsZero() && tm.After(t.limit) {
+		return t.limit
+	}
+	return tm
+}
+
+func utime(ctx context.Context, o *options, t *tree, pg *progress) error {
+	if len(t.files) == 0 {
+		return nil
+	}
+
+	r, err := resolve(ctx, o, t, pg)
+	if err != nil {
+		return err
+	}
+	return apply(o, t, r)
+}
+
+// resolution represents the commits which determine the modification time.
+type resolution struct {
+	files   map[string]*logEntry
+	entries map[string]*logEntry // directories dated by the changes of their entries
+	skipped map[string][]skipped // recorded only if the tree is traced
+	notes   map[string]string    // recorded only if the tree is traced
+}
+
+// skipped represents a commit which is skipped for a file.
+type skipped struct {
+	hash   string
+	reason string
+}
+
+func (r *resolution) skip(p string, c *logEntry, reason string) {
+	if r.skipped != nil {
+		r.skipped[p] = append(r.skipped[p], skipped{c.hash, reason})
+	}
+}
+
+// note records how the file is resolved, or why it is not updated.
+func (r *resolution) note(p, s string) {
+	if r.notes != nil {
+		r.notes[p] = s
+	}
+}
+
+// resolve walks the history, and resolves the commits for the files in the
+// tree. The resolved files are removed from the tree.
+func resolve(ctx context.Context, o *options, t *tree, pg *progress) (*resolution, error) {
+	r := &resolution{
+		files:   make(map[string]*logEntry),
+		entries: make(map[string]*logEntry),
+	}
+	if t.trace {
+		r.skipped = make(map[string][]skipped)
+		r.notes = make(map[string]string)
+	}
+	files := t.files
+	top := path.Clean(t.prefix)
+	// directories which are dated by the changes of their entries
+	pending := make(fileset)
+	if o.dirTime == "entries" {
+		for p := range files {
+			for p != top {
+				p = path.Dir(p)
+				pending[p] = struct{}{}
+			}
+		}
+	}
+	// blobs which have to be matched
+	var blobs map[string]string
+	if o.byContent || o.allRefs {
+		var err error
+		rev := t.rev
+		if rev == "" {
+			rev = "HEAD"
+		}
+		if blobs, err = lsTree(ctx, t.wt, rev, t.pathspec()...); err != nil {
+			return nil, err
+		}
+	}
+	ignored, err := ignoredCommits(ctx, o, t.wt, t.rev)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi, err := window(ctx, o, t.wt)
+	if err != nil {
+		return nil, err
+	}
+	epoch := time.Unix(0, 0)
+	for p, v := range t.attrs {
+		if _, ok := files[p]; ok && v == "epoch" {
+			delete(files, p)
+			r.files[p] = &logEntry{time: epoch, committer: epoch, author: epoch}
+			pg.inc()
+		}
+	}
+
+	args := append([]string{"-C", t.wt, "log", "--pretty=" + logFormat, o.diffMerges, "-z", "--raw", "--no-abbrev", "--no-color", "--no-renames"}, revs(o, t.rev)...)
+	if o.ignoreWhitespace {
+		args = append(args, "--numstat", "-w")
+	}
+	if o.dirTime == "entries" {
+		// added or deleted directories are also entries
+		args = append(args, "-t")
+	}
+	if !lo.IsZero() {
+		// stop at the commits older than -since
+		args = append(args, "--max-age="+strconv.FormatInt(lo.Unix(), 10))
+	}
+	if o.maxCount > 0 {
+		// one more commit to know whether the history is truncated
+		args = append(args, "--max-count="+strconv.Itoa(o.maxCount+1))
+	}
+	args = append(args, "--")
+	if o.maxFiles <= 0 {
+		// all changes are required to count files
+		args = append(args, t.pathspec()...)
+	}
+	// the oldest commit seen, the number of commits, and whether the
+	// history is truncated by -max-count
+	var oldest *logEntry
+	var n int
+	var truncated bool
+	err = git(ctx, args, func(out *bufio.Reader) error {
+		cond := func() bool { return (len(files) > 0 || len(pending) > 0) && ctx.Err() == nil }
+		return readLog(out, cond, func(c *logEntry) error {
+			c.time = c.committer
+			if o.dateSource == "author" {
+				c.time = c.author
+			}
+			if oldest == nil || c.hash != oldest.hash {
+				// a merge commit can be passed for each parent
+				n++
+			}
+			if o.maxCount > 0 && n > o.maxCount {
+				truncated = true
+				return nil
+			}
+			oldest = c
+			reason, ok := ignored[c.hash]
+			if !ok && o.maxFiles > 0 && c.files() > o.maxFiles {
+				reason = fmt.Sprintf("changes more than %d files", o.maxFiles)
+			}
+			if reason != "" {
+				for _, ch := range c.changes {
+					if _, ok := files[ch.path]; ok {
+						r.skip(ch.path, c, reason)
+					}
+				}
+				return nil
+			}
+			for _, ch := range c.changes {
+				switch {
+				case o.ignoreModes && ch.modeOnly():
+					reason = "mode changes only"
+				case o.ignoreWhitespace && strings.Trim(ch.status, "M") == "" && !ch.stat:
+					reason = "whitespace changes only"
+				default:
+					reason = ""
+				}
+				if reason != "" {
+					if _, ok := files[ch.path]; ok {
+						r.skip(ch.path, c, reason)
+					}
+					continue
+				}
+				if strings.ContainsAny(ch.status, "AD") {
+					d := path.Dir(ch.path)
+					if _, ok := pending[d]; ok {
+						delete(pending, d)
+						r.entries[d] = c
+					}
+				}
+				if _, ok := files[ch.path]; !ok {
+					continue
+				}
+				if t.attrs[ch.path] == "first-commit" {
+					// the commit which added the file
+					if _, ok := r.files[ch.path]; !ok {
+						pg.inc()
+					}
+					r.files[ch.path] = c
+					if strings.Trim(ch.status, "A") == "" {
+						delete(files, ch.path)
+					}
+					continue
+				}
+				if blobs != nil {
+					// the oldest commit which introduced the blob
+					if ch.blob == blobs[ch.path] {
+						switch old, ok := r.files[ch.path]; {
+						case !ok:
+							pg.inc()
+							fallthrough
+						case !c.time.After(old.time):
+							r.files[ch.path] = dated(c, t.attrs[ch.path])
+						}
+					}
+					continue
+				}
+				delete(files, ch.path)
+				r.files[ch.path] = dated(c, t.attrs[ch.path])
+				pg.inc()
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		abort(err)
+		return nil, err
 	}
-	if err := utimeAll(wt); err != nil {
-		abort(err)
+	if truncated {
+		// files which are not resolved within -max-count
+		for p := range files {
+			switch _, ok := r.files[p]; {
+			case ok:
+			case o.fallback == "oldest":
+				r.files[p] = oldest
+				r.note(p, "resolved approximately by -fallback=oldest")
+				pg.fallback()
+			default:
+				r.note(p, "not resolved within -max-count")
+			}
+		}
 	}
+	if !lo.IsZero() || !hi.IsZero() {
+		if !lo.IsZero() {
+			// files which are not changed since
+			for p := range files {
+				if _, ok := r.files[p]; ok {
+					continue
+				}
+				if o.outside == "clamp" {
+					r.files[p] = &logEntry{time: lo}
+					r.note(p, "not changed since -since, clamped to it")
+					pg.inc()
+				} else {
+					r.note(p, "not changed since -since")
+				}
+			}
+		}
+		for i, m := range []map[string]*logEntry{r.files, r.entries} {
+			for p, c := range m {
+				var tm time.Time
+				var s string
+				switch {
+				case !lo.IsZero() && c.time.Before(lo):
+					tm, s = lo, "-since"
+				case !hi.IsZero() && c.time.After(hi):
+					tm, s = hi, "-until"
+				default:
+					continue
+				}
+				if o.outside == "skip" {
+					delete(m, p)
+					if i == 0 {
+						r.note(p, "changed outside of -since and -until")
+					}
+					continue
+				}
+				e := *c
+				e.time = tm
+				m[p] = &e
+				if i == 0 {
+					r.note(p, "clamped to "+s)
+				}
+			}
+		}
+	}
+	for p := range r.files {
+		delete(files, p)
+	}
+	return r, nil
 }
 
-type mergeValue struct {
-	s       *string
-	on, off string
-}
-
-func newMergeValue(p *string, v string) *mergeValue {
-	return &mergeValue{
-		s:   p,
-		on:  v,
-		off: *p,
+// window returns the limits specified by -since and -until.
+func window(ctx context.Context, o *options, wt string) (lo, hi time.Time, err error) {
+	if o.since != "" {
+		if lo, err = approxidate(ctx, wt, "--since", o.since); err != nil {
+			return
+		}
 	}
+	if o.until != "" {
+		hi, err = approxidate(ctx, wt, "--until", o.until)
+	}
+	return
 }
 
-func (m *mergeValue) Set(s string) error {
-	v, err := strconv.ParseBool(s)
-	switch {
-	case err != nil:
-		err = errParse
-	case v:
-		*m.s = m.on
-	case *m.s == m.on:
-		*m.s = m.off
+// approxidate parses the date in the same way as git.
+func approxidate(ctx context.Context, wt, opt, date string) (time.Time, error) {
+	s, err := revParse(ctx, wt, opt+"="+date)
+	if err != nil {
+		return time.Time{}, err
 	}
-	return err
+	_, v, _ := strings.Cut(s, "=")
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, errParse
+	}
+	return time.Unix(n, 0), nil
 }
 
-func (m *mergeValue) Get() any         { return m.s != nil && *m.s == m.on }
-func (m *mergeValue) String() string   { return strconv.FormatBool(m.s != nil && *m.s == m.on) }
-func (m *mergeValue) IsBoolFlag() bool { return true }
-
-func abort(err error) {
-	if err, ok := err.(*exec.ExitError); ok {
-		os.Exit(err.ExitCode())
+// dated returns the commit dated by the specified value of the utime
+// attribute.
+func dated(c *logEntry, attr string) *logEntry {
+	var tm time.Time
+	switch attr {
+	case "author":
+		tm = c.author
+	case "committer":
+		tm = c.committer
+	default:
+		return c
 	}
-	fmt.Fprintln(stderr, "error:", err)
-	os.Exit(1)
+	e := *c
+	e.time = tm
+	// changes are valid only in fn of readLog
+	e.changes = nil
+	return &e
 }
 
-type fileset map[string]struct{}
-
-func getwt() (wt string, err error) {
-	err = git([]string{"rev-parse", "--show-toplevel"}, func(out *bufio.Reader) error {
-		wt, err = out.ReadString('\n')
-		if err == nil {
-			wt = filepath.FromSlash(strings.TrimRight(wt, "\r\n"))
+// apply updates the modification time of the files and directories in the
+// tree.
+func apply(o *options, t *tree, r *resolution) error {
+	var fails failures
+	for _, f := range slices.Sorted(maps.Keys(r.files)) {
+		tm := t.at(r.files[f].time)
+		p := filepath.Join(t.wt, filepath.FromSlash(f))
+		if err := lutimes(p, tm, tm); err != nil {
+			if !o.keepGoing {
+				return err
+			}
+			fails.add(p, err)
+			continue
 		}
-		return err
-	})
-	return
+		t.applied = append(t.applied, f)
+	}
+	dirs, _ := dirTimes(o, t, r)
+	list := slices.Sorted(maps.Keys(dirs))
+	slices.Reverse(list)
+	for _, d := range list {
+		tm := dirs[d]
+		p := filepath.Join(t.wt, filepath.FromSlash(d))
+		if err := lutimes(p, tm, tm); err != nil {
+			if !o.keepGoing {
+				return err
+			}
+			fails.add(p, err)
+		}
+	}
+	if len(fails) > 0 {
+		return fails
+	}
+	return nil
 }
 
-func utimeAll(wt string) error {
-	order := []string{wt}
-	if *recurse {
-		mods, err := submodules(wt)
-		if err != nil {
-			return err
+// dirTimes returns the modification times of the directories in the tree,
+// and the paths which determine them. A directory which is dated by the
+// changes of its entries is determined by no path.
+func dirTimes(o *options, t *tree, r *resolution) (dirs map[string]time.Time, from map[string]string) {
+	top := path.Clean(t.prefix)
+	dirs = make(map[string]time.Time)
+	from = make(map[string]string)
+	for f, c := range r.files {
+		tm := t.at(c.time)
+		for d := f; d != top; {
+			d = path.Dir(d)
+			if tm.After(dirs[d]) || (tm.Equal(dirs[d]) && f < from[d]) {
+				dirs[d] = tm
+				from[d] = f
+			}
 		}
-		order = append(order, mods...)
 	}
-	dirs := make(map[string]fileset, len(order))
-	var m, n int
-	for _, p := range order {
-		files, err := ls(p)
+	for d, c := range r.entries {
+		dirs[d] = t.at(c.time)
+		delete(from, d)
+	}
+	// directories which have modified or untracked entries
+	type entry struct {
+		mtime time.Time
+		p     string
+	}
+	latest := make(map[string]entry)
+	for p := range t.dirty {
+		fi, err := os.Lstat(filepath.Join(t.wt, filepath.FromSlash(p)))
 		if err != nil {
-			return err
+			// deleted: the parent directory has been modified
+			fi, err = os.Lstat(filepath.Join(t.wt, filepath.FromSlash(path.Dir(p))))
+		}
+		var mtime time.Time
+		if err == nil {
+			mtime = fi.ModTime()
+		}
+		for d := p; d != top; {
+			d = path.Dir(d)
+			if e, ok := latest[d]; !ok || e.mtime.Before(mtime) {
+				latest[d] = entry{mtime, p}
+			}
 		}
-		dirs[p] = files
-		n += len(files)
 	}
-	for i := len(dirs) - 1; i >= 0; i-- {
-		p := order[i]
-		m += len(dirs[p])
-		if err := utime(p, dirs[p], m, n); err != nil {
-			return err
+	for d, e := range latest {
+		switch tm, ok := dirs[d]; {
+		case o.dirtyDirs == "keep" || e.mtime.IsZero():
+			delete(dirs, d)
+			delete(from, d)
+		case !ok || tm.Before(e.mtime):
+			dirs[d] = e.mtime
+			from[d] = e.p
 		}
 	}
-	return nil
+	return
 }
 
-func submodules(path string) (mods []string, err error) {
-	err = git([]string{"-C", path, "submodule", "status", "--recursive"}, func(out *bufio.Reader) error {
+// lsTree returns the blobs of the files in the tree of the specified
+// revision.
+func lsTree(ctx context.Context, wt, rev string, pathspec ...string) (map[string]string, error) {
+	blobs := make(map[string]string)
+	err := git(ctx, append([]string{"-C", wt, "ls-tree", "-r", "-z", rev, "--"}, pathspec...), func(out *bufio.Reader) error {
 		for {
-			s, err := out.ReadString('\n')
-			switch {
-			case err != nil:
+			s, err := out.ReadString('\x00')
+			if err != nil {
 				return err
-			case s[0] == '-':
-				continue
 			}
-			mods = append(mods, filepath.Join(path, strings.SplitN(s[1:], " ", 3)[1]))
+			// <mode> SP <type> SP <object> TAB <file>
+			i := strings.IndexByte(s, '\t')
+			f := strings.Fields(s[:max(i, 0)])
+			if len(f) != 3 {
+				return errParse
+			}
+			blobs[s[i+1:len(s)-1]] = f[2]
 		}
 	})
-	return
+	return blobs, err
 }
 
-func ls(path string) (fileset, error) {
-	files := make(fileset)
-	err := git([]string{"-C", path, "ls-files", "-z"}, func(out *bufio.Reader) error {
-		for {
-			p, err := out.ReadString('\x00')
-			if err != nil {
-				return err
+// revs returns the revisions to walk from.
+func revs(o *options, rev string) []string {
+	switch {
+	case o.allRefs:
+		return []string{"--exclude=refs/stash", "--all"}
+	case rev != "":
+		return []string{rev}
+	}
+	return nil
+}
+
+// ignoredCommits returns the commits which should be ignored, and the reasons
+// for them.
+func ignoredCommits(ctx context.Context, o *options, wt, rev string) (map[string]string, error) {
+	commits := make(map[string]string)
+	for _, f := range []struct {
+		opt    string
+		list   listValue
+		reason string
+	}{
+		{"--author", o.ignoreAuthors, "author matches -ignore-author"},
+		{"--committer", o.ignoreCommitters, "committer matches -ignore-committer"},
+		{"--grep", o.ignoreMessages, "message matches -ignore-message"},
+	} {
+		if len(f.list) == 0 {
+			continue
+		}
+		args := append([]string{"-C", wt, "log", "--pretty=%H", "-E"}, revs(o, rev)...)
+		for _, re := range f.list {
+			args = append(args, f.opt+"="+re)
+		}
+		err := git(ctx, args, func(out *bufio.Reader) error {
+			for {
+				s, err := out.ReadString('\n')
+				if err != nil {
+					return err
+				}
+				h := strings.TrimRight(s, "\r\n")
+				if _, ok := commits[h]; !ok {
+					commits[h] = f.reason
+				}
 			}
-			files[p[:len(p)-1]] = struct{}{}
+		})
+		if err != nil {
+			return nil, err
 		}
-	})
+	}
+
+	// same as git blame
+	vars, err := gitConfig(ctx, wt, "--path", "--get-regexp", `^blame\.ignorerevsfile$`)
 	if err != nil {
 		return nil, err
 	}
-	// filter modified
-	err = git([]string{"-C", path, "status", "-z", "--porcelain"}, func(out *bufio.Reader) error {
-		for {
-			s, err := out.ReadString('\x00')
-			if err != nil {
-				return err
+	var list []string
+	for _, v := range vars {
+		switch {
+		case v.value == "":
+			list = nil
+		case !filepath.IsAbs(v.value):
+			v.value = filepath.Join(wt, v.value)
+			fallthrough
+		default:
+			if _, err := os.Stat(v.value); err == nil {
+				list = append(list, v.value)
 			}
-			delete(files, s[3:len(s)-1])
-			// renamed or copied
-			switch s[0] {
-			case 'R', 'C':
-				p, err := out.ReadString('\x00')
-				if err != nil {
-					return err
-				}
-				delete(files, p[:len(p)-1])
+		}
+	}
+	for _, name := range o.ignoreRevsFiles {
+		if name == "" {
+			list = nil
+		} else {
+			list = append(list, name)
+		}
+	}
+	for _, name := range list {
+		revs, err := readRevs(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range revs {
+			if _, ok := commits[h]; !ok {
+				commits[h] = "listed in " + name
 			}
 		}
-	})
-	return files, err
+	}
+	return commits, nil
 }
 
-func utime(wt string, files fileset, m, n int) error {
-	if len(files) == 0 {
-		return nil
+// readRevs reads the file in the format of blame.ignoreRevsFile.
+func readRevs(name string) (revs []string, err error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	for l := range strings.Lines(string(b)) {
+		l = strings.TrimSpace(l)
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		h := strings.Fields(l)[0]
+		if _, err := hex.DecodeString(h); err != nil || (len(h) != 40 && len(h) != 64) {
+			return nil, fmt.Errorf("%v: invalid object name: %v", name, h)
+		}
+		revs = append(revs, strings.ToLower(h))
+	}
+	return
+}
+
+const logFormat = "%n%x00%H%x00%cD%x00%aD"
+
+type logEntry struct {
+	hash      string
+	time      time.Time // committer or author date by -date-source
+	committer time.Time
+	author    time.Time
+	changes   []change
+}
+
+type change struct {
+	status string
+	mode   string
+	blob   string
+	src    []string // blobs of the parents
+	path   string
+	stat   bool // listed by --numstat
+	tree   bool // listed by -t
+}
+
+// files returns the number of the changed files.
+func (c *logEntry) files() (n int) {
+	for _, ch := range c.changes {
+		if !ch.tree {
+			n++
+		}
+	}
+	return
+}
+
+// modeOnly reports whether only the mode has been changed.
+func (ch *change) modeOnly() bool {
+	if strings.Trim(ch.status, "M") != "" {
+		return false
 	}
+	for _, b := range ch.src {
+		if b != ch.blob {
+			return false
+		}
+	}
+	return true
+}
 
-	dirs := make(map[string]time.Time)
-	err := git([]string{"-C", wt, "log", "--pretty=%n%x00%cD", diffMerges, "-z", "--name-only", "--no-color", "--no-renames"}, func(out *bufio.Reader) error {
-		var done bool
-		defer func() {
-			if m == n && done {
-				fmt.Fprintln(stdout)
+// readLog reads the output of git log with the --raw and -z options, and
+// calls fn for each commit which has changes while cond returns true.
+func readLog(out *bufio.Reader, cond func() bool, fn func(*logEntry) error) error {
+	var eof bool
+	var c *logEntry
+	// whether c has been passed to fn
+	var done bool
+	for !eof && cond() {
+		l, err := out.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				return err
 			}
-		}()
+			eof = true
+		}
+		l = strings.TrimRight(l, "\r\n")
 
-		var eof bool
-		var tm time.Time
-		for !eof && len(files) > 0 {
-			l, err := out.ReadString('\n')
-			if err != nil {
-				if err != io.EOF {
+		switch {
+		case l == "":
+			continue
+		case l[0] == '\x00':
+			if c != nil && !done {
+				// commit without changes
+				if err := fn(c); err != nil {
 					return err
 				}
-				eof = true
 			}
-			l = strings.TrimRight(l, "\r\n")
-
-			switch {
-			case l == "":
+			v := strings.SplitN(l[1:], "\x00", 4)
+			if len(v) != 4 {
+				return errParse
+			}
+			c = &logEntry{hash: v[0]}
+			done = false
+			if c.committer, err = time.Parse(rfc2822, v[1]); err != nil {
+				return err
+			}
+			if c.author, err = time.Parse(rfc2822, v[2]); err != nil {
+				return err
+			}
+			switch v[3] {
+			case "":
+				// commit: changes are in the next line
 				continue
-			case l[0] == '\x00':
-				l = l[1:]
-				i := strings.IndexByte(l, '\x00')
-				tm, err = time.Parse(rfc2822, l[:i])
-				if err != nil {
-					return err
-				}
-				switch l[i:] {
-				case "\x00":
-					// commit: file names are in the next line
-					continue
-				case "\x00\x00":
-					// merge commit: no file names
-					continue
-				default:
-					// merge commit: file names are in the same line
-					l = l[i+2:]
-				}
+			case "\x00":
+				// merge commit: no changes
+				continue
+			default:
+				// merge commit: changes are in the same line
+				l = v[3][1:]
 			}
-			for p := range strings.SplitSeq(l, "\x00") {
-				if _, ok := files[p]; !ok {
-					continue
-				}
-				delete(files, p)
+		}
+		if c == nil {
+			return errParse
+		}
+		c.changes, err = parseChanges(l)
+		if err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+		// changes are valid only in fn
+		c.changes = nil
+		done = true
+	}
+	if eof && c != nil && !done {
+		// commit without changes
+		return fn(c)
+	}
+	return nil
+}
 
-				p = filepath.Join(wt, p)
-				if err := lutimes(p, tm, tm); err != nil {
-					return err
-				}
-				for p != wt {
-					p = filepath.Dir(p)
-					if _, ok := dirs[p]; !ok {
-						dirs[p] = tm
-					}
-				}
-				fmt.Fprintf(stdout, "\rutime: %3d%% (%d/%d)", (m-len(files))*100/n, m-len(files), n)
-				done = true
+// parseChanges parses the raw and numstat output formats of git diff.
+func parseChanges(l string) (changes []change, err error) {
+	v := strings.Split(strings.TrimSuffix(l, "\x00"), "\x00")
+	// numstat can precede raw for combined diffs
+	stats := make(map[string]bool)
+	for i := 0; i < len(v); i++ {
+		if !strings.HasPrefix(v[i], ":") {
+			// numstat
+			f := strings.SplitN(v[i], "\t", 3)
+			if len(f) != 3 {
+				return nil, errParse
 			}
+			stats[f[2]] = true
+			continue
 		}
-		return nil
-	})
-	if err != nil {
-		return err
+		// number of parents
+		n := len(v[i]) - len(strings.TrimLeft(v[i], ":"))
+		f := strings.Fields(v[i][n:])
+		if len(f) != 2*(n+1)+1 || i+1 == len(v) {
+			return nil, errParse
+		}
+		changes = append(changes, change{
+			status: f[len(f)-1],
+			mode:   f[n],
+			blob:   f[2*n+1],
+			src:    f[n+1 : 2*n+1],
+			path:   v[i+1],
+			tree:   slices.Contains(f[:n+1], "040000"),
+		})
+		i++
+	}
+	for i := range changes {
+		changes[i].stat = stats[changes[i].path]
 	}
+	return
+}
 
-	list := make(sort.StringSlice, len(dirs))
-	i := 0
-	for k := range dirs {
-		list[i] = k
-		i++
+func lastCommit(ctx context.Context, o *options, wt, p string) (tm time.Time, err error) {
+	format := "%cD"
+	if o.dateSource == "author" {
+		format = "%aD"
 	}
-	sort.Sort(sort.Reverse(list))
-	for _, p := range list {
-		tm := dirs[p]
-		if err := lutimes(p, tm, tm); err != nil {
+	err = git(ctx, []string{"-C", wt, "log", "-1", "--pretty=" + format, o.diffMerges, "--", p}, func(out *bufio.Reader) error {
+		s, err := out.ReadString('\n')
+		if err != nil {
 			return err
 		}
+		tm, err = time.Parse(rfc2822, strings.TrimRight(s, "\r\n"))
+		return err
+	})
+	return
+}
+
+// refreshIndex refreshes the stat information of the files in the index.
+func refreshIndex(ctx context.Context, path string, files []string) error {
+	var b strings.Builder
+	for _, f := range files {
+		b.WriteString(f)
+		b.WriteByte('\x00')
 	}
-	return nil
+	args := []string{"--literal-pathspecs", "-C", path, "add", "--refresh", "--pathspec-from-file=-", "--pathspec-file-nul"}
+	return gitInput(ctx, args, strings.NewReader(b.String()), func(out *bufio.Reader) error {
+		_, err := io.Copy(io.Discard, out)
+		return err
+	})
+}
+
+type configVar struct {
+	key, value string
+}
+
+func gitConfig(ctx context.Context, path string, args ...string) (vars []configVar, err error) {
+	err = git(ctx, append([]string{"-C", path, "config", "-z"}, args...), func(out *bufio.Reader) error {
+		for {
+			s, err := out.ReadString('\x00')
+			if err != nil {
+				return err
+			}
+			k, v, ok := strings.Cut(s[:len(s)-1], "\n")
+			if !ok {
+				// boolean variable without a value
+				v = "true"
+			}
+			vars = append(vars, configVar{k, v})
+		}
+	})
+	// exit status 1 means that no variables are found
+	if err, ok := err.(*exec.ExitError); ok && err.ExitCode() == 1 {
+		return vars, nil
+	}
+	return vars, err
+}
+
+func git(ctx context.Context, args []string, fn func(*bufio.Reader) error) error {
+	return gitInput(ctx, args, nil, fn)
 }
 
-func git(args []string, fn func(*bufio.Reader) error) error {
-	cmd := exec.Command("git", append([]string{"-c", "core.quotepath=false"}, args...)...)
+func gitInput(ctx context.Context, args []string, in io.Reader, fn func(*bufio.Reader) error) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.quotepath=false"}, args...)...)
+	cmd.Stdin = in
 	cmd.Stderr = stderr
+	if label := labelOf(ctx); label != "" {
+		lw := &labelWriter{w: stderr, label: label}
+		defer lw.Close()
+		cmd.Stderr = lw
+	}
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return err
@@ -292,7 +2112,11 @@ func git(args []string, fn func(*bufio.Reader) error) error {
 	if err != io.EOF {
 		cmd.Process.Kill()
 		cmd.Wait()
-		return err
+	} else {
+		err = cmd.Wait()
 	}
-	return cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
@@ -1,7 +1,7 @@
 //
 // git-utime :: utime_test.go
 //
-//   Copyright (c) 2021-2023 Akinori Hattori <hattya@gmail.com>
+//   Copyright (c) 2021-2026 Akinori Hattori <hattya@gmail.com>
 //
 //   SPDX-License-Identifier: MIT
 //
@@ -9,11 +9,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -107,7 +117,7 @@ type fileTest struct {
 func init() {
 	stdout = io.Discard
 	stderr = io.Discard
-	*recurse = true
+	opts.recurse = true
 }
 
 func TestNoRepo(t *testing.T) {
@@ -118,16 +128,16 @@ func TestNoRepo(t *testing.T) {
 	}
 	defer popd()
 
-	if _, err := getwt(); err == nil {
+	if _, err := getwt(t.Context(), "."); err == nil {
 		t.Fatal("expected error")
 	}
-	if _, err := submodules(dir); err == nil {
+	if _, err := submodules(t.Context(), opts, dir); err == nil {
 		t.Fatal("expected error")
 	}
-	if _, err := ls(dir); err == nil {
+	if _, _, err := ls(t.Context(), opts, dir, ""); err == nil {
 		t.Fatal("expected error")
 	}
-	if err := utimeAll(dir); err == nil {
+	if err := utimeAll(t.Context(), opts, dir, "", ""); err == nil {
 		t.Fatal("expected error")
 	}
 }
@@ -141,25 +151,25 @@ func TestEmptyRepo(t *testing.T) {
 
 	init_()
 
-	wt, err := getwt()
+	wt, err := getwt(t.Context(), ".")
 	if err != nil {
 		t.Fatal(err)
 	}
-	mods, err := submodules(wt)
+	mods, err := submodules(t.Context(), opts, wt)
 	switch {
 	case err != nil:
 		t.Fatal(err)
 	case len(mods) != 0:
 		t.Fatalf("expected empty, got %v", mods)
 	}
-	files, err := ls(wt)
+	files, _, err := ls(t.Context(), opts, wt, "")
 	switch {
 	case err != nil:
 		t.Fatal(err)
 	case len(files) != 0:
 		t.Fatalf("expected empty, got %v", files)
 	}
-	if err := utimeAll(wt); err != nil {
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -198,11 +208,11 @@ func TestCommits(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	wt, err := getwt()
+	wt, err := getwt(t.Context(), ".")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := utimeAll(wt); err != nil {
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
 	for _, tt := range []fileTest{
@@ -232,14 +242,15 @@ func TestCommits(t *testing.T) {
 	if err := mv(filepath.Join("bar", "bar"), filepath.Join("bar", "baz")); err != nil {
 		t.Fatal(err)
 	}
+	dir := stat("bar")
 
-	if err := utimeAll(wt); err != nil {
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
 	for _, tt := range []fileTest{
 		{log[0], filepath.Join("bar", "foo")},
-		{log[0], "bar"},
-		{log[0], "."},
+		{dir, "bar"},
+		{log[1], "."},
 		{log[1], filepath.Join("bar", "baz")},
 		{now, "foo"},
 	} {
@@ -249,7 +260,7 @@ func TestCommits(t *testing.T) {
 	}
 }
 
-func TestMergeCommits(t *testing.T) {
+func TestDirTime(t *testing.T) {
 	popd, err := pushd(t.TempDir())
 	if err != nil {
 		t.Fatal(err)
@@ -262,7 +273,13 @@ func TestMergeCommits(t *testing.T) {
 	}
 	// commit
 	log = append(log, "2021-07-07T12:00:00")
-	if err := file("foo", "1"); err != nil {
+	if err := mkdir("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("foo", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("foo", "bar", "file"); err != nil {
 		t.Fatal(err)
 	}
 	if err := commit(t, log[0]); err != nil {
@@ -270,157 +287,2462 @@ func TestMergeCommits(t *testing.T) {
 	}
 	// commit
 	log = append(log, "2021-07-07T13:00:00")
-	if err := checkout("-b", "ff"); err != nil {
+	if err := file(filepath.Join("foo", "file"), "."); err != nil {
 		t.Fatal(err)
 	}
-	if err := file("foo", "2"); err != nil {
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T14:00:00")
+	if err := touch("foo", "bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T15:00:00")
+	if err := rm(filepath.Join("foo", "bar", "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], filepath.Join("foo", "file")},
+		{log[2], filepath.Join("foo", "bar", "baz")},
+		{log[2], filepath.Join("foo", "bar")},
+		{log[2], "foo"},
+		{log[2], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	flag.Set("dir-time", "entries")
+	defer flag.Set("dir-time", "contents")
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], filepath.Join("foo", "file")},
+		{log[2], filepath.Join("foo", "bar", "baz")},
+		{log[3], filepath.Join("foo", "bar")},
+		{log[0], "foo"},
+		{log[0], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	// commit: nested directories
+	log = append(log, "2021-07-07T16:00:00")
+	if err := mkdir("baz", "qux"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("baz", "qux", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[4]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T17:00:00")
+	if err := file(filepath.Join("baz", "qux", "file"), "."); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[5], filepath.Join("baz", "qux", "file")},
+		{log[4], filepath.Join("baz", "qux")},
+		{log[4], "baz"},
+		{log[0], "foo"},
+		{log[4], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	if err := flag.Set("dir-time", "_"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDirtyDirs(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	for _, dir := range []string{"foo", "bar", "baz"} {
+		if err := mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if err := touch(dir, "file"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mkdir("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("foo", "bar", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// modify
+	old := "2021-01-01T00:00:00"
+	modified := "2021-07-07T23:59:59"
+	untracked := "2021-07-07T23:00:00"
+	for _, tt := range []fileTest{
+		{modified, filepath.Join("foo", "bar", "file")},
+		{untracked, filepath.Join("bar", "untracked")},
+	} {
+		if err := file(tt.path, "."); err != nil {
+			t.Fatal(err)
+		}
+		tm, err := time.ParseInLocation(iso8601, tt.mtime, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lutimes(tt.path, tm, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm, err := time.ParseInLocation(iso8601, old, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join("foo", "bar"), "foo", "bar", "."} {
+		if err := lutimes(p, tm, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{old, filepath.Join("foo", "bar")},
+		{log[0], filepath.Join("foo", "file")},
+		{old, "foo"},
+		{log[0], filepath.Join("bar", "file")},
+		{old, "bar"},
+		{log[0], filepath.Join("baz", "file")},
+		{log[0], "baz"},
+		{old, "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	flag.Set("dirty-dirs", "latest")
+	defer flag.Set("dirty-dirs", "keep")
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{modified, filepath.Join("foo", "bar")},
+		{modified, "foo"},
+		{untracked, "bar"},
+		{log[0], "baz"},
+		{modified, "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestIgnoreCommits(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if err := touch(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit: author
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("foo", "."); err != nil {
 		t.Fatal(err)
 	}
+	t.Setenv("GIT_AUTHOR_NAME", "dependabot[bot]")
 	if err := commit(t, log[1]); err != nil {
 		t.Fatal(err)
 	}
-	// merge
+	t.Setenv("GIT_AUTHOR_NAME", "Utime")
+	// commit: committer
 	log = append(log, "2021-07-07T14:00:00")
-	if err := checkout("master"); err != nil {
+	if err := file("bar", "."); err != nil {
 		t.Fatal(err)
 	}
-	if err := merge(t, "ff", log[2]); err != nil {
+	t.Setenv("GIT_COMMITTER_EMAIL", "ci@example.com")
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_COMMITTER_EMAIL", "utime@example.com")
+	// commit: message
+	log = append(log, "2021-07-07T15:00:00")
+	if err := file("baz", "."); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "commit", "--amend", "-m", "style: apply gofmt").Run(); err != nil {
 		t.Fatal(err)
 	}
 
-	wt, err := getwt()
+	wt, err := getwt(t.Context(), ".")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if err := utimeAll(wt); err != nil {
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
 	for _, tt := range []fileTest{
 		{log[1], "foo"},
-		{log[1], "."},
+		{log[2], "bar"},
+		{log[3], "baz"},
+		{log[3], "."},
 	} {
 		if mtime := stat(tt.path); mtime != tt.mtime {
 			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
 		}
 	}
-	// specify -c
-	flag.Set("c", "true")
-	if err := utimeAll(wt); err != nil {
+
+	flag.Set("ignore-author", `\[bot\]`)
+	flag.Set("ignore-committer", "^ci@")
+	flag.Set("ignore-committer", "<ci@")
+	flag.Set("ignore-message", "^style:")
+	defer func() {
+		opts.ignoreAuthors = nil
+		opts.ignoreCommitters = nil
+		opts.ignoreMessages = nil
+	}()
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
 	for _, tt := range []fileTest{
-		{log[1], "foo"},
-		{log[1], "."},
+		{log[0], "foo"},
+		{log[0], "bar"},
+		{log[0], "baz"},
+		{log[0], "."},
 	} {
 		if mtime := stat(tt.path); mtime != tt.mtime {
 			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
 		}
 	}
-	// specify -m
-	flag.Set("m", "true")
-	if err := utimeAll(wt); err != nil {
+}
+
+func TestIgnoreRevs(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("foo", "."); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file(filepath.Join(".git", "ignore-revs"), "# gofmt\n"+string(out)); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := stat("foo"), log[1]; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	// blame.ignoreRevsFile
+	if err := exec.Command("git", "config", "--add", "blame.ignoreRevsFile", "_").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "config", "--add", "blame.ignoreRevsFile", filepath.Join(".git", "ignore-revs")).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := stat("foo"), log[0]; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	// reset
+	flag.Set("ignore-revs-file", "")
+	defer func() { opts.ignoreRevsFiles = nil }()
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := stat("foo"), log[1]; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	// invalid
+	if err := file("revs", "HEAD\n"); err != nil {
+		t.Fatal(err)
+	}
+	flag.Set("ignore-revs-file", "revs")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err == nil {
+		t.Error("expected error")
+	}
+	opts.ignoreRevsFiles = listValue{"_"}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := mkdir("bar"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo", filepath.Join("bar", "file")} {
+		if err := touch(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	for _, name := range []string{"foo", filepath.Join("bar", "file"), filepath.Join("bar", "baz")} {
+		if err := file(name, "."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T14:00:00")
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.maxFiles = 2
+	defer func() { opts.maxFiles = 0 }()
+	opts.here = true
+	defer func() { opts.here = false }()
+
+	if err := run(t.Context(), "bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], filepath.Join("bar", "file")},
+		{log[0], "bar"},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	if mtime := stat(filepath.Join("bar", "baz")); mtime == log[1] {
+		t.Errorf("%v: expected not %v", filepath.Join("bar", "baz"), mtime)
+	}
+
+	opts.here = false
+	if err := run(t.Context(), ".", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[2], "foo"},
+		{log[0], filepath.Join("bar", "file")},
+		{log[2], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestIgnoreChanges(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := file("foo", "foo\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("bar", "bar\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit: mode
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("bar", "baz\n"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GIT_AUTHOR_DATE", log[1])
+	t.Setenv("GIT_COMMITTER_DATE", log[1])
+	for _, args := range [][]string{
+		{"add", "bar"},
+		{"update-index", "--chmod=+x", "foo", "bar"},
+		{"commit", "-m", "."},
+		{"reset", "-q", "--hard"},
+	} {
+		if err := exec.Command("git", args...).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// commit: whitespace
+	log = append(log, "2021-07-07T14:00:00")
+	if err := file("bar", "baz  \n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{log[2], "bar"},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	opts.ignoreModes = true
+	defer func() { opts.ignoreModes = false }()
+	opts.ignoreWhitespace = true
+	defer func() { opts.ignoreWhitespace = false }()
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], "foo"},
+		{log[1], "bar"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// merge commit: conflict resolution
+	log = append(log, "2021-07-07T15:00:00")
+	if err := checkout("-b", "topic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("foo", "topic\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[3]); err != nil {
+		t.Fatal(err)
+	}
+	log = append(log, "2021-07-07T16:00:00")
+	if err := checkout("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("foo", "master\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[4]); err != nil {
+		t.Fatal(err)
+	}
+	log = append(log, "2021-07-07T17:00:00")
+	if err := merge(t, "topic", log[5]); err == nil {
+		t.Fatal("expected conflict")
+	}
+	if err := file("foo", "merged\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[5]); err != nil {
+		t.Fatal(err)
+	}
+
+	flag.Set("c", "true")
+	defer flag.Set("c", "false")
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[5], "foo"},
+		{log[1], "bar"},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := mkdir("gen"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range [][]string{
+		{"foo"},
+		{"bar.lock"},
+		{"gen", "a.pb.go"},
+		{"gen", "b.go"},
+	} {
+		if err := touch(s...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file(".utimeignore", "*.pb.go\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("bar.lock", "bar\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("gen/a.pb.go", "a\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	flag.Set("exclude", "*.lock")
+	defer func() { opts.fileExcludes = nil }()
+
+	mtime := map[string]string{
+		"bar.lock":    stat("bar.lock"),
+		"gen/a.pb.go": stat("gen/a.pb.go"),
+	}
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], "foo"},
+		{mtime["bar.lock"], "bar.lock"},
+		{mtime["gen/a.pb.go"], "gen/a.pb.go"},
+		{log[0], "gen/b.go"},
+		{log[0], "gen"},
+		{log[0], ".utimeignore"},
+		{log[0], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	for _, name := range []string{"author", "epoch", "first", "skip"} {
+		if err := file(name, "1\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := file(".gitattributes", "author utime=author\nepoch utime=epoch\nfirst utime=first-commit\nskip utime=skip\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00", "2021-07-07T14:00:00")
+	for _, name := range []string{"author", "epoch", "first", "skip"} {
+		if err := file(name, "2\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+	// amend
+	t.Setenv("GIT_AUTHOR_DATE", log[1])
+	if err := exec.Command("git", "commit", "-q", "--amend", "--no-edit", "--reset-author").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := stat("skip")
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "author"},
+		{time.Unix(0, 0).Format(iso8601), "epoch"},
+		{log[0], "first"},
+		{mtime, "skip"},
+		{log[0], ".gitattributes"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestByContent(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := file("foo", "1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("bar", "1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("foo", "2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("bar", "2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// commit: revert
+	log = append(log, "2021-07-07T14:00:00")
+	if err := file("foo", "1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[2], "foo"},
+		{log[1], "bar"},
+		{log[2], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	opts.byContent = true
+	defer func() { opts.byContent = false }()
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], "foo"},
+		{log[1], "bar"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestAllRefs(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := file("foo", "1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := checkout("-b", "topic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("bar", "1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T14:00:00")
+	if err := checkout("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("bar", "1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.byContent = true
+	defer func() { opts.byContent = false }()
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], "foo"},
+		{log[2], "bar"},
+		{log[2], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	opts.byContent = false
+	opts.allRefs = true
+	defer func() { opts.allRefs = false }()
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], "foo"},
+		{log[1], "bar"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestDateSource(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-08T12:00:00", "2021-07-08T13:00:00")
+	if err := file("foo", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// amend
+	t.Setenv("GIT_AUTHOR_DATE", log[0])
+	if err := exec.Command("git", "commit", "-q", "--amend", "--no-edit", "--reset-author").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		source string
+		mtime  string
+	}{
+		{"committer", log[1]},
+		{"author", log[0]},
+	} {
+		opts.dateSource = tt.source
+		if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"foo", "."} {
+			if mtime := stat(p); mtime != tt.mtime {
+				t.Errorf("%v: %v: expected %v, got %v", tt.source, p, tt.mtime, mtime)
+			}
+		}
+	}
+	opts.dateSource = "committer"
+}
+
+func TestExplain(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := mkdir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("foo", "1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("dir", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("foo", "2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	var hash []string
+	for _, rev := range []string{"HEAD~", "HEAD"} {
+		b, err := exec.Command("git", "rev-parse", rev).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash = append(hash, strings.TrimSpace(string(b)))
+	}
+	if err := file("revs", hash[1]+"\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	flag.Set("ignore-revs-file", "revs")
+	defer func() { opts.ignoreRevsFiles = nil }()
+
+	var b strings.Builder
+	stdout = &b
+	defer func() { stdout = io.Discard }()
+
+	if err := explain(t.Context(), []string{"foo", "dir/", ".", "revs", "baz"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"merges:  none\n",
+		"flags:   -ignore-revs-file=revs",
+		"\nfoo\n    commit:    " + hash[0] + "\n",
+		"    skipped:   " + hash[1] + " (listed in revs)\n",
+		"\ndir\n    child:     dir/bar\n",
+		"\n.\n    not updated: has modified or untracked entries\n",
+		"\nrevs\n    not updated: modified or untracked\n",
+		"\nbaz\n    not updated: not tracked or excluded\n",
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %q in %q", s, b.String())
+		}
+	}
+	for _, s := range []string{"foo", "dir", "."} {
+		if mtime := stat(s); mtime == log[0] {
+			t.Errorf("%v: expected not to be updated", s)
+		}
+	}
+
+	// window
+	b.Reset()
+	flag.Set("since", log[1])
+	defer func() { opts.since = "" }()
+
+	if err := explain(t.Context(), []string{"foo"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"-since=" + log[1],
+		"\nfoo\n    not updated: not changed since -since\n",
+	} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected %q in %q", s, b.String())
+		}
+	}
+
+	if err := explain(t.Context(), nil); err == nil {
+		t.Error("expected error")
+	}
+	if err := explain(t.Context(), []string{"../foo"}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestShow(t *testing.T) {
+	dir := t.TempDir()
+	if err := mkdir(dir, "repo"); err != nil {
+		t.Fatal(err)
+	}
+	popd, err := pushd(filepath.Join(dir, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := mkdir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("dir", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("dir/bar", "bar\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	var hash []string
+	for _, rev := range []string{"HEAD~", "HEAD"} {
+		b, err := exec.Command("git", "rev-parse", rev).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash = append(hash, strings.TrimSpace(string(b)))
+	}
+	iso := func(s string) string {
+		tm, _ := time.ParseInLocation(iso8601, s, time.Local)
+		return tm.Format(time.RFC3339)
+	}
+	if err := exec.Command("git", "clone", "-q", "--bare", ".", filepath.Join(dir, "bare.git")).Run(); err != nil {
+		t.Fatal(err)
+	}
+	// modified
+	if err := file("foo", "foo\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	stdout = &b
+	defer func() { stdout = io.Discard }()
+
+	for _, tt := range []struct {
+		dir    string
+		args   []string
+		flags  [][2]string
+		output string
+	}{
+		{
+			dir:    ".",
+			output: hash[1] + " " + iso(log[1]) + "\tdir/bar\n" + hash[0] + " " + iso(log[0]) + "\tfoo\n",
+		},
+		{
+			dir:    "dir",
+			output: hash[1] + " " + iso(log[1]) + "\tdir/bar\n",
+		},
+		{
+			dir:    "dir",
+			args:   []string{"../foo"},
+			output: hash[0] + " " + iso(log[0]) + "\tfoo\n",
+		},
+		{
+			dir:    ".",
+			flags:  [][2]string{{"rev", "HEAD~"}, {"format", "%h %aI %p %%"}, {"z", "true"}},
+			output: hash[0][:7] + " " + iso(log[0]) + " dir/bar %\x00" + hash[0][:7] + " " + iso(log[0]) + " foo %\x00",
+		},
+		{
+			dir:    ".",
+			flags:  [][2]string{{"since", log[1]}, {"outside", "clamp"}, {"format", "%mI %cI %p"}},
+			output: iso(log[1]) + " " + iso(log[1]) + " dir/bar\n" + iso(log[1]) + "  foo\n",
+		},
+		{
+			dir:    filepath.Join(dir, "bare.git"),
+			output: hash[1] + " " + iso(log[1]) + "\tdir/bar\n" + hash[0] + " " + iso(log[0]) + "\tfoo\n",
+		},
+	} {
+		b.Reset()
+		func() {
+			popd, err := pushd(tt.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer popd()
+
+			for _, f := range tt.flags {
+				flag.Set(f[0], f[1])
+			}
+			defer func() {
+				opts.revision = ""
+				*format = "%H %mI\t%p"
+				*nulTerminated = false
+				opts.since = ""
+				opts.outside = "skip"
+			}()
+
+			if err := show(t.Context(), tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if g, e := b.String(), tt.output; g != e {
+				t.Errorf("%v %v: expected %q, got %q", tt.dir, tt.args, e, g)
+			}
+		}()
+	}
+	if mtime := stat("foo"); mtime == log[0] {
+		t.Error("foo: expected not to be updated")
+	}
+}
+
+func TestRev(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("foo", "foo\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T14:00:00")
+	if err := file("bar", "bar\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	flag.Set("rev", "HEAD~")
+	defer func() { opts.revision = "" }()
+
+	mtime := stat("bar")
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{mtime, "bar"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if err := touch(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := file("bar", "bar\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T14:00:00")
+	if err := file("baz", "baz\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := "2021-07-07T13:30:00"
+	flag.Set("since", log[1])
+	flag.Set("until", limit)
+	defer func() {
+		opts.since = ""
+		opts.until = ""
+		opts.outside = "skip"
+	}()
+
+	mtime := map[string]string{
+		"foo": stat("foo"),
+		"baz": stat("baz"),
+	}
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// skip
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{mtime["foo"], "foo"},
+		{log[1], "bar"},
+		{mtime["baz"], "baz"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// clamp
+	flag.Set("outside", "clamp")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{log[1], "bar"},
+		{limit, "baz"},
+		{limit, "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	if err := flag.Set("outside", "_"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMaxCount(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"foo", "bar", "baz"} {
+		// commit
+		log = append(log, fmt.Sprintf("2021-07-07T%02d:00:00", 12+i))
+		if err := touch(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(t, log[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flag.Set("max-count", "2")
+	defer func() {
+		opts.maxCount = 0
+		opts.fallback = "oldest"
+	}()
+
+	var b strings.Builder
+	stdout = &b
+	defer func() { stdout = io.Discard }()
+
+	mtime := stat("foo")
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// none
+	flag.Set("fallback", "none")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{mtime, "foo"},
+		{log[1], "bar"},
+		{log[2], "baz"},
+		{log[2], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	if strings.Contains(b.String(), "approximately") {
+		t.Errorf("unexpected output: %q", b.String())
+	}
+	// oldest
+	flag.Set("fallback", "oldest")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{log[1], "bar"},
+		{log[2], "baz"},
+		{log[2], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	if g, e := b.String(), "utime: 1 file(s) resolved approximately\n"; !strings.HasSuffix(g, e) {
+		t.Errorf("expected %q, got %q", e, g)
+	}
+	// empty commits
+	for i := range 2 {
+		log = append(log, fmt.Sprintf("2021-07-07T%02d:00:00", 15+i))
+		t.Setenv("GIT_AUTHOR_DATE", log[3+i])
+		t.Setenv("GIT_COMMITTER_DATE", log[3+i])
+		if err := exec.Command("git", "commit", "--allow-empty", "-m", ".").Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Reset()
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[3], "foo"},
+		{log[3], "bar"},
+		{log[3], "baz"},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	if g, e := b.String(), "utime: 3 file(s) resolved approximately\n"; !strings.HasSuffix(g, e) {
+		t.Errorf("expected %q, got %q", e, g)
+	}
+	// merge commits
+	log = append(log, "2021-07-07T17:00:00")
+	if err := checkout("-b", "topic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("qux"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[5]); err != nil {
+		t.Fatal(err)
+	}
+	log = append(log, "2021-07-07T18:00:00")
+	if err := checkout("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := merge(t, "topic", log[6]); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		flag.Set("c", "false")
+		flag.Set("m", "false")
+	}()
+	for _, tt := range []struct {
+		flag  string
+		files []fileTest
+	}{
+		{
+			files: []fileTest{
+				{log[4], "foo"},
+				{log[5], "qux"},
+			},
+		},
+		{
+			flag: "c",
+			files: []fileTest{
+				{log[5], "foo"},
+				{log[5], "qux"},
+			},
+		},
+		{
+			flag: "m",
+			files: []fileTest{
+				{log[5], "foo"},
+				{log[6], "qux"},
+			},
+		},
+	} {
+		if tt.flag != "" {
+			flag.Set(tt.flag, "true")
+		}
+		if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		for _, ft := range tt.files {
+			if mtime := stat(ft.path); mtime != ft.mtime {
+				t.Errorf("-%v: %v: expected %v, got %v", tt.flag, ft.path, ft.mtime, mtime)
+			}
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// untouched files are not refreshed
+	flag.Set("exclude", "bar")
+	defer func() { opts.fileExcludes = nil }()
+
+	mtime := statIndex("bar")
+	tm := time.Date(2021, 7, 7, 0, 0, 0, 0, time.Local)
+	if err := os.Chtimes("bar", tm, tm); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no refresh
+	flag.Set("refresh", "false")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := statIndex("foo"), log[0]; g == e {
+		t.Errorf("expected not %v", e)
+	}
+	// refresh
+	flag.Set("refresh", "true")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := statIndex("foo"), log[0]; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	if g, e := statIndex("bar"), mtime; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+}
+
+func TestHere(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := mkdir("bar", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("bar", "baz", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("bar", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	now := "2021-07-07T23:59:59"
+	tm, err := time.ParseInLocation(iso8601, now, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"foo", "."} {
+		if err := lutimes(p, tm, tm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts.here = true
+	defer func() { opts.here = false }()
+
+	if err := run(t.Context(), filepath.Join("bar", "baz"), ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], filepath.Join("bar", "baz", "file")},
+		{log[0], filepath.Join("bar", "baz")},
+		{now, "foo"},
+		{now, "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	if err := run(t.Context(), "bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], filepath.Join("bar", "baz", "file")},
+		{log[0], filepath.Join("bar", "baz")},
+		{log[1], filepath.Join("bar", "file")},
+		{log[1], "bar"},
+		{now, "foo"},
+		{now, "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := touch("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _, err := ls(t.Context(), opts, wt, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// remove after ls
+	if err := os.Remove("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := utime(t.Context(), opts, &tree{wt: wt, files: maps.Clone(files)}, &progress{n: len(files)}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	opts.keepGoing = true
+	defer func() { opts.keepGoing = false }()
+
+	err = utime(t.Context(), opts, &tree{wt: wt, files: maps.Clone(files)}, &progress{n: len(files)})
+	fails, ok := err.(failures)
+	switch {
+	case !ok:
+		t.Fatalf("expected failures, got %#v", err)
+	case len(fails) != 1:
+		t.Fatalf("expected 1, got %v", fails)
+	}
+	if g, e := fails[0].Path, filepath.Join(wt, "foo"); g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	if fails[0].Errno == 0 {
+		t.Error("expected errno")
+	}
+	for _, tt := range []fileTest{
+		{log[0], "bar"},
+		{log[0], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	// report
+	var b strings.Builder
+	stdout = &b
+	defer func() { stdout = io.Discard }()
+
+	*jsonOutput = true
+	defer func() { *jsonOutput = false }()
+
+	report(fails)
+	var v failures
+	if err := json.Unmarshal([]byte(b.String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, fails) {
+		t.Errorf("expected %v, got %v", fails, v)
+	}
+	// progress is not written to stdout
+	b.Reset()
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if g := b.String(); g != "" {
+		t.Errorf("expected no output, got %q", g)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	if err := touch("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, "2021-07-07T12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	switch err := utimeAll(ctx, opts, wt, "", ""); {
+	case !errors.Is(err, context.Canceled):
+		t.Fatalf("expected context.Canceled, got %v", err)
+	case !strings.Contains(err.Error(), "(while listing files, 0 files listed)"):
+		t.Errorf("unexpected error: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(t.Context(), 0)
+	defer cancel()
+	if err := utimeAll(ctx, opts, wt, "", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		list []string
+		b    bool
+		s    string
+	}{
+		{
+			args: []string{"foo", "bar"},
+			list: []string{"foo", "bar"},
+		},
+		{
+			args: []string{"foo", "-b", "bar", "-s", "baz", "qux"},
+			list: []string{"foo", "bar", "qux"},
+			b:    true,
+			s:    "baz",
+		},
+		{
+			args: []string{"-s=baz", "foo", "--", "-b", "bar"},
+			list: []string{"foo", "-b", "bar"},
+			s:    "baz",
+		},
+	} {
+		fs := flag.NewFlagSet("", flag.ContinueOnError)
+		b := fs.Bool("b", false, "")
+		s := fs.String("s", "", "")
+		list, err := parseArgs(fs, tt.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(list, tt.list) {
+			t.Errorf("%q: expected %q, got %q", tt.args, tt.list, list)
+		}
+		if *b != tt.b {
+			t.Errorf("%q: expected %v, got %v", tt.args, tt.b, *b)
+		}
+		if *s != tt.s {
+			t.Errorf("%q: expected %q, got %q", tt.args, tt.s, *s)
+		}
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := parseArgs(fs, []string{"foo", "-_"}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestRepos(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	for i, name := range []string{"foo", "bar"} {
+		if err := mkdir(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chdir(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := init_(); err != nil {
+			t.Fatal(err)
+		}
+		// commit
+		log = append(log, fmt.Sprintf("2021-07-07T1%v:00:00", i+2))
+		if err := touch("file"); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(t, log[i]); err != nil {
+			t.Fatal(err)
+		}
+		// popd
+		if err := os.Chdir(".."); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := file("repos", "foo\x00bar\x00"); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := readRepos("repos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := repos, []string{"foo", "bar"}; !reflect.DeepEqual(g, e) {
+		t.Fatalf("expected %v, got %v", e, g)
+	}
+	stdin = strings.NewReader("foo\x00bar")
+	defer func() { stdin = os.Stdin }()
+	repos, err = readRepos("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := repos, []string{"foo", "bar"}; !reflect.DeepEqual(g, e) {
+		t.Fatalf("expected %v, got %v", e, g)
+	}
+	if _, err := readRepos("_"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	var b strings.Builder
+	stdout = &b
+	defer func() { stdout = io.Discard }()
+
+	if g, e := runAll(t.Context(), repos), 0; g != e {
+		t.Fatalf("expected %v, got %v", e, g)
+	}
+	for _, tt := range []fileTest{
+		{log[0], filepath.Join("foo", "file")},
+		{log[0], "foo"},
+		{log[1], filepath.Join("bar", "file")},
+		{log[1], "bar"},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	for _, name := range repos {
+		if l := name + ": utime: 100% (1/1)\n"; !strings.Contains(b.String(), l) {
+			t.Errorf("expected %q in %q", l, b.String())
+		}
+	}
+
+	// git config of each repository
+	if err := exec.Command("git", "-C", "bar", "config", "utime.exclude", "file").Run(); err != nil {
+		t.Fatal(err)
+	}
+	// flags which are set by other tests
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	flag.CommandLine = fs
+
+	now := time.Now()
+	for _, name := range repos {
+		if err := os.Chtimes(filepath.Join(name, "file"), now, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g, e := runAll(t.Context(), repos), 0; g != e {
+		t.Fatalf("expected %v, got %v", e, g)
+	}
+	for _, tt := range []fileTest{
+		{log[0], filepath.Join("foo", "file")},
+		{now.Format(iso8601), filepath.Join("bar", "file")},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	// labeled error output
+	var eb strings.Builder
+	stderr = &eb
+	defer func() { stderr = io.Discard }()
+
+	if g, e := runAll(t.Context(), append(repos, "baz")), 1; g != e {
+		t.Fatalf("expected %v, got %v", e, g)
+	}
+	for _, l := range []string{
+		"baz: fatal: ",
+		"error: baz: exit status 128\n",
+	} {
+		if !strings.Contains(eb.String(), l) {
+			t.Errorf("expected %q in %q", l, eb.String())
+		}
+	}
+	eb.Reset()
+	warn(withLabel(t.Context(), "foo"), "submodule '%v'", "bar")
+	if g, e := eb.String(), "foo: warning: submodule 'bar'\n"; g != e {
+		t.Errorf("expected %q, got %q", e, g)
+	}
+}
+
+func TestMergeCommits(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+
+	var log []string
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := file("foo", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := checkout("-b", "ff"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("foo", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// merge
+	log = append(log, "2021-07-07T14:00:00")
+	if err := checkout("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := merge(t, "ff", log[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// specify -c
+	flag.Set("c", "true")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{log[1], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// specify -m
+	flag.Set("m", "true")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[2], "foo"},
+		{log[2], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// reset
+	flag.Set("c", "false")
+	flag.Set("m", "false")
+
+	// commit
+	log = append(log, "2021-07-07T15:00:00")
+	if err := touch("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[3]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T16:00:00")
+	if err := file("bar", "1\n2\n3\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[4]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T17:00:00")
+	if err := checkout("-b", "no-ff", "@~1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := file("bar", "3\n2\n1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[5]); err != nil {
+		t.Fatal(err)
+	}
+	// merge
+	log = append(log, "2021-07-07T18:00:00")
+	if err := checkout("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := merge(t, "no-ff", log[6]); err == nil {
+		t.Fatal("expected merge conflict")
+	}
+	if err := file("bar", "Let's Go!\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[6]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{log[5], "bar"},
+		{log[5], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// specify -c
+	flag.Set("c", "true")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], "foo"},
+		{log[6], "bar"},
+		{log[6], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// specify -m
+	flag.Set("m", "true")
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[2], "foo"},
+		{log[6], "bar"},
+		{log[6], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+	// reset
+	flag.Set("c", "false")
+	flag.Set("m", "false")
+}
+
+func TestSubmodule(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+	t.Setenv("GIT_ALLOW_PROTOCOL", "file")
+
+	var log []string
+	// repository: baz
+	if err := mkdir("baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T12:00:00")
+	if err := touch("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[0]); err != nil {
+		t.Fatal(err)
+	}
+	// popd
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+
+	// repository: bar
+	if err := mkdir("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T13:00:00")
+	if err := touch("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[1]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T14:00:00")
+	if err := addSubmodule("../baz", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[2]); err != nil {
+		t.Fatal(err)
+	}
+	// popd
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+
+	// repository foo
+	if err := mkdir("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T15:00:00")
+	if err := touch("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[3]); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	log = append(log, "2021-07-07T16:00:00")
+	if err := addSubmodule("../bar", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, log[4]); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mods, err := submodules(t.Context(), opts, wt)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case len(mods) != 1:
+		t.Errorf("expected 1, got %v", mods)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[1], filepath.Join("bar", "file")},
+		{log[2], filepath.Join("bar", "baz")},
+		{log[3], "file"},
+		{log[4], "bar"},
+		{log[4], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+
+	if err := initSubmodules(); err != nil {
+		t.Fatal(err)
+	}
+
+	mods, err = submodules(t.Context(), opts, wt)
+	switch {
+	case err != nil:
+		t.Fatal(err)
+	case len(mods) != 2:
+		t.Errorf("expected 1, got %v", mods)
+	}
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []fileTest{
+		{log[0], filepath.Join("bar", "baz", "file")},
+		{log[1], filepath.Join("bar", "file")},
+		{log[2], filepath.Join("bar", "baz")},
+		{log[3], "file"},
+		{log[4], "bar"},
+		{log[4], "."},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestSelectSubmodules(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer popd()
+	t.Setenv("GIT_ALLOW_PROTOCOL", "file")
+
+	// repository: sub
+	if err := mkdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	if err := touch("file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, "2021-07-07T12:00:00"); err != nil {
+		t.Fatal(err)
+	}
+	// popd
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+
+	// repository: foo
+	if err := mkdir("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := init_(); err != nil {
+		t.Fatal(err)
+	}
+	// commit
+	if err := addSubmodule("../sub", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "submodule", "add", "--name", "qux", "../sub", "baz").Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(t, "2021-07-07T13:00:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
 		t.Fatal(err)
 	}
-	for _, tt := range []fileTest{
-		{log[2], "foo"},
-		{log[2], "."},
+	bar := filepath.Join(wt, "bar")
+	baz := filepath.Join(wt, "baz")
+	for _, tt := range []struct {
+		modules, excludes []string
+		config            []string
+		mods              []string
+	}{
+		{
+			mods: []string{bar, baz},
+		},
+		{
+			modules: []string{"qux"},
+			mods:    []string{baz},
+		},
+		{
+			modules: []string{"bar/"},
+			mods:    []string{bar},
+		},
+		{
+			excludes: []string{"q*"},
+			mods:     []string{bar},
+		},
+		{
+			excludes: []string{"ba[rz]"},
+		},
+		{
+			config: []string{"submodule.qux.utime", "no"},
+			mods:   []string{bar},
+		},
+		{
+			config: []string{"-f", ".gitmodules", "submodule.bar.utime", "false"},
+			mods:   []string{baz},
+		},
 	} {
-		if mtime := stat(tt.path); mtime != tt.mtime {
-			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		opts.modules = tt.modules
+		opts.submoduleExcludes = tt.excludes
+		if tt.config != nil {
+			if err := exec.Command("git", append([]string{"config"}, tt.config...)...).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mods, err := submodules(t.Context(), opts, wt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(mods, tt.mods) {
+			t.Errorf("expected %v, got %v", tt.mods, mods)
+		}
+		if tt.config != nil {
+			if err := exec.Command("git", append([]string{"config", "--unset"}, tt.config[:len(tt.config)-1]...)...).Run(); err != nil {
+				t.Fatal(err)
+			}
 		}
 	}
 	// reset
-	flag.Set("c", "false")
-	flag.Set("m", "false")
+	opts.modules = nil
+	opts.submoduleExcludes = nil
 
-	// commit
-	log = append(log, "2021-07-07T15:00:00")
-	if err := touch("bar"); err != nil {
+	// out of sync
+	if err := os.Chdir("bar"); err != nil {
 		t.Fatal(err)
 	}
-	if err := commit(t, log[3]); err != nil {
+	if err := exec.Command("git", "-c", "user.name=Utime", "-c", "user.email=utime@example.com", "commit", "--allow-empty", "-m", ".").Run(); err != nil {
 		t.Fatal(err)
 	}
-	// commit
-	log = append(log, "2021-07-07T16:00:00")
-	if err := file("bar", "1\n2\n3\n"); err != nil {
+	if err := os.Chdir(".."); err != nil {
 		t.Fatal(err)
 	}
-	if err := commit(t, log[4]); err != nil {
+	mods, err := submodules(t.Context(), opts, wt)
+	if err != nil {
 		t.Fatal(err)
 	}
-	// commit
-	log = append(log, "2021-07-07T17:00:00")
-	if err := checkout("-b", "no-ff", "@~1"); err != nil {
-		t.Fatal(err)
+	if g, e := mods, []string{bar, baz}; !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
 	}
-	if err := file("bar", "3\n2\n1\n"); err != nil {
+	opts.skipOutOfSync = true
+	defer func() { opts.skipOutOfSync = false }()
+	mods, err = submodules(t.Context(), opts, wt)
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := commit(t, log[5]); err != nil {
-		t.Fatal(err)
+	if g, e := mods, []string{baz}; !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
 	}
-	// merge
-	log = append(log, "2021-07-07T18:00:00")
-	if err := checkout("master"); err != nil {
+}
+
+func TestParallelSubmodules(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := merge(t, "no-ff", log[6]); err == nil {
-		t.Fatal("expected merge conflict")
+	defer popd()
+	t.Setenv("GIT_ALLOW_PROTOCOL", "file")
+
+	defer func(fn func() chan struct{}) { limiter = fn }(limiter)
+	limiter = sync.OnceValue(func() chan struct{} { return make(chan struct{}, 4) })
+
+	var log []string
+	for _, tt := range []struct {
+		repo string
+		mods []string
+	}{
+		{repo: "baz"},
+		{repo: "bar", mods: []string{"baz"}},
+		{repo: "qux"},
+		{repo: "foo", mods: []string{"bar", "qux"}},
+	} {
+		if err := mkdir(tt.repo); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chdir(tt.repo); err != nil {
+			t.Fatal(err)
+		}
+		if err := init_(); err != nil {
+			t.Fatal(err)
+		}
+		// commit
+		log = append(log, fmt.Sprintf("2021-07-07T%02d:00:00", 12+len(log)))
+		if err := touch("file"); err != nil {
+			t.Fatal(err)
+		}
+		if err := commit(t, log[len(log)-1]); err != nil {
+			t.Fatal(err)
+		}
+		if len(tt.mods) > 0 {
+			// commit
+			log = append(log, fmt.Sprintf("2021-07-07T%02d:00:00", 12+len(log)))
+			for _, m := range tt.mods {
+				if err := addSubmodule("../"+m, m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := commit(t, log[len(log)-1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// popd
+		if err := os.Chdir(".."); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if err := file("bar", "Let's Go!\n"); err != nil {
+	if err := os.Chdir("foo"); err != nil {
 		t.Fatal(err)
 	}
-	if err := commit(t, log[6]); err != nil {
+	if err := initSubmodules(); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := utimeAll(wt); err != nil {
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
 		t.Fatal(err)
 	}
-	for _, tt := range []fileTest{
-		{log[1], "foo"},
-		{log[5], "bar"},
-		{log[5], "."},
-	} {
-		if mtime := stat(tt.path); mtime != tt.mtime {
-			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
-		}
-	}
-	// specify -c
-	flag.Set("c", "true")
-	if err := utimeAll(wt); err != nil {
+	bar := filepath.Join(wt, "bar")
+	baz := filepath.Join(wt, "bar", "baz")
+	qux := filepath.Join(wt, "qux")
+	_, _, deps, err := plan(t.Context(), opts, wt, "", &progress{})
+	if err != nil {
 		t.Fatal(err)
 	}
-	for _, tt := range []fileTest{
-		{log[1], "foo"},
-		{log[6], "bar"},
-		{log[6], "."},
-	} {
-		if mtime := stat(tt.path); mtime != tt.mtime {
-			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
-		}
+	if g, e := deps, map[string][]string{wt: {bar, qux}, bar: {baz}}; !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
 	}
-	// specify -m
-	flag.Set("m", "true")
-	if err := utimeAll(wt); err != nil {
+	// gitlinks and directories of the superprojects are updated after the
+	// contents of their submodules
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
 	for _, tt := range []fileTest{
-		{log[2], "foo"},
-		{log[6], "bar"},
-		{log[6], "."},
+		{log[0], filepath.Join("bar", "baz", "file")},
+		{log[1], filepath.Join("bar", "file")},
+		{log[2], filepath.Join("bar", "baz")},
+		{log[3], filepath.Join("qux", "file")},
+		{log[4], "file"},
+		{log[5], "bar"},
+		{log[5], "qux"},
+		{log[5], "."},
 	} {
 		if mtime := stat(tt.path); mtime != tt.mtime {
 			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
 		}
 	}
-	// reset
-	flag.Set("c", "false")
-	flag.Set("m", "false")
 }
 
-func TestSubmodule(t *testing.T) {
+func TestSubmoduleClamp(t *testing.T) {
 	popd, err := pushd(t.TempDir())
 	if err != nil {
 		t.Fatal(err)
@@ -429,18 +2751,18 @@ func TestSubmodule(t *testing.T) {
 	t.Setenv("GIT_ALLOW_PROTOCOL", "file")
 
 	var log []string
-	// repository: baz
-	if err := mkdir("baz"); err != nil {
+	// repository: bar
+	if err := mkdir("bar"); err != nil {
 		t.Fatal(err)
 	}
-	if err := os.Chdir("baz"); err != nil {
+	if err := os.Chdir("bar"); err != nil {
 		t.Fatal(err)
 	}
 	if err := init_(); err != nil {
 		t.Fatal(err)
 	}
 	// commit
-	log = append(log, "2021-07-07T12:00:00")
+	log = append(log, "2021-07-07T14:00:00")
 	if err := touch("file"); err != nil {
 		t.Fatal(err)
 	}
@@ -452,11 +2774,11 @@ func TestSubmodule(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// repository: bar
-	if err := mkdir("bar"); err != nil {
+	// repository: foo
+	if err := mkdir("foo"); err != nil {
 		t.Fatal(err)
 	}
-	if err := os.Chdir("bar"); err != nil {
+	if err := os.Chdir("foo"); err != nil {
 		t.Fatal(err)
 	}
 	if err := init_(); err != nil {
@@ -464,102 +2786,259 @@ func TestSubmodule(t *testing.T) {
 	}
 	// commit
 	log = append(log, "2021-07-07T13:00:00")
-	if err := touch("file"); err != nil {
+	if err := addSubmodule("../bar", "bar"); err != nil {
 		t.Fatal(err)
 	}
 	if err := commit(t, log[1]); err != nil {
 		t.Fatal(err)
 	}
-	// commit
-	log = append(log, "2021-07-07T14:00:00")
-	if err := addSubmodule("../baz", "baz"); err != nil {
+
+	wt, err := getwt(t.Context(), ".")
+	if err != nil {
 		t.Fatal(err)
 	}
-	if err := commit(t, log[2]); err != nil {
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
-	// popd
-	if err := os.Chdir(".."); err != nil {
-		t.Fatal(err)
+	for _, tt := range []fileTest{
+		{log[0], filepath.Join("bar", "file")},
+		{log[1], "bar"},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
 	}
 
-	// repository foo
-	if err := mkdir("foo"); err != nil {
+	opts.clamp = true
+	defer func() { opts.clamp = false }()
+
+	if err := utimeAll(t.Context(), opts, wt, "", ""); err != nil {
 		t.Fatal(err)
 	}
-	if err := os.Chdir("foo"); err != nil {
+	for _, tt := range []fileTest{
+		{log[1], filepath.Join("bar", "file")},
+		{log[1], "bar"},
+	} {
+		if mtime := stat(tt.path); mtime != tt.mtime {
+			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	popd, err := pushd(t.TempDir())
+	if err != nil {
 		t.Fatal(err)
 	}
+	defer popd()
+
 	if err := init_(); err != nil {
 		t.Fatal(err)
 	}
-	// commit
-	log = append(log, "2021-07-07T15:00:00")
-	if err := touch("file"); err != nil {
-		t.Fatal(err)
+	for _, args := range [][]string{
+		{"config", "utime.recurse", "no"},
+		{"config", "utime.merges", "m"},
+		{"config", "utime.dateSource", "author"},
+		{"config", "utime.ignoreAuthor", "foo"},
+		{"config", "--add", "utime.ignoreAuthor", "bar"},
+		{"config", "utime.jobs", "2"},
+		{"config", "utime.z", "yes"},
+	} {
+		if err := exec.Command("git", args...).Run(); err != nil {
+			t.Fatal(err)
+		}
 	}
-	if err := commit(t, log[3]); err != nil {
+	defer func() {
+		opts.dateSource = "committer"
+		*jobs = runtime.NumCPU()
+		*nulTerminated = false
+	}()
+
+	// flags which are set by other tests
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	defer func(fs *flag.FlagSet) { flag.CommandLine = fs }(flag.CommandLine)
+	flag.CommandLine = fs
+
+	// command line takes precedence
+	if err := flag.Set("j", "4"); err != nil {
 		t.Fatal(err)
 	}
-	// commit
-	log = append(log, "2021-07-07T16:00:00")
-	if err := addSubmodule("../bar", "bar"); err != nil {
+	if err := config(t.Context(), ".", globals()); err != nil {
 		t.Fatal(err)
 	}
-	if err := commit(t, log[4]); err != nil {
-		t.Fatal(err)
+	if g, e := *jobs, 4; g != e {
+		t.Errorf("expected %v, got %v", e, g)
 	}
-
-	wt, err := getwt()
+	if g, e := *nulTerminated, true; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	o, err := repoOptions(t.Context(), ".")
 	if err != nil {
 		t.Fatal(err)
 	}
-	mods, err := submodules(wt)
-	switch {
-	case err != nil:
-		t.Fatal(err)
-	case len(mods) != 1:
-		t.Errorf("expected 1, got %v", mods)
+	if g, e := o.recurse, false; g != e {
+		t.Errorf("expected %v, got %v", e, g)
 	}
-	if err := utimeAll(wt); err != nil {
-		t.Fatal(err)
+	if g, e := o.diffMerges, "-m"; g != e {
+		t.Errorf("expected %v, got %v", e, g)
 	}
-	for _, tt := range []fileTest{
-		{log[1], filepath.Join("bar", "file")},
-		{log[2], filepath.Join("bar", "baz")},
-		{log[3], "file"},
-		{log[4], "bar"},
-		{log[4], "."},
+	if g, e := o.dateSource, "author"; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	if g, e := o.ignoreAuthors, (listValue{"foo", "bar"}); !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	// flags are not changed
+	if g, e := opts.recurse, true; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	if g, e := opts.diffMerges, "--no-merges"; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	if opts.ignoreAuthors != nil {
+		t.Errorf("expected nil, got %v", opts.ignoreAuthors)
+	}
+
+	for _, args := range [][]string{
+		{"config", "utime.merges", "_"},
+		{"config", "utime.dateSource", "_"},
 	} {
-		if mtime := stat(tt.path); mtime != tt.mtime {
-			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		if err := exec.Command("git", args...).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repoOptions(t.Context(), "."); err == nil {
+			t.Errorf("expected error: %v", args[1:])
+		}
+		if err := exec.Command("git", "config", "--unset", args[1]).Run(); err != nil {
+			t.Fatal(err)
 		}
 	}
 
-	if err := initSubmodules(); err != nil {
+	// repositories
+	for _, name := range []string{"bar", "baz"} {
+		if err := exec.Command("git", "init", "-q", name).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exec.Command("git", "-C", "bar", "config", "utime.dateSource", "author").Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path, source string
+	}{
+		{"bar", "author"},
+		{"baz", "committer"},
+	} {
+		o, err := repoOptions(t.Context(), tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, e := o.dateSource, tt.source; g != e {
+			t.Errorf("%v: expected %v, got %v", tt.path, e, g)
+		}
+	}
+	if err := flag.Set("date-source", "committer"); err != nil {
+		t.Fatal(err)
+	}
+	o, err = repoOptions(t.Context(), "bar")
+	if err != nil {
 		t.Fatal(err)
 	}
+	if g, e := o.dateSource, "committer"; g != e {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	if _, err := repoOptions(t.Context(), "qux"); err == nil {
+		t.Error("expected error")
+	}
+}
 
-	mods, err = submodules(wt)
-	switch {
-	case err != nil:
+func TestParseChanges(t *testing.T) {
+	const (
+		null = "0000000000000000000000000000000000000000"
+		foo  = "0123456789abcdef0123456789abcdef01234567"
+		bar  = "89abcdef0123456789abcdef0123456789abcdef"
+	)
+	changes, err := parseChanges(":000000 100644 " + null + " " + foo + " A\x00foo\x00:100644 100755 " + foo + " " + foo + " M\x00foo bar\x000\t0\tfoo\x00")
+	if err != nil {
 		t.Fatal(err)
-	case len(mods) != 2:
-		t.Errorf("expected 1, got %v", mods)
 	}
-	if err := utimeAll(wt); err != nil {
+	if g, e := changes, []change{
+		{status: "A", mode: "100644", blob: foo, src: []string{null}, path: "foo", stat: true},
+		{status: "M", mode: "100755", blob: foo, src: []string{foo}, path: "foo bar"},
+	}; !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	if changes[0].modeOnly() {
+		t.Error("expected false")
+	}
+	if !changes[1].modeOnly() {
+		t.Error("expected true")
+	}
+	changes, err = parseChanges(":040000 000000 " + foo + " " + null + " D\x00foo\x00")
+	if err != nil {
 		t.Fatal(err)
 	}
-	for _, tt := range []fileTest{
-		{log[0], filepath.Join("bar", "baz", "file")},
-		{log[1], filepath.Join("bar", "file")},
-		{log[2], filepath.Join("bar", "baz")},
-		{log[3], "file"},
-		{log[4], "bar"},
-		{log[4], "."},
+	if g, e := changes, []change{
+		{status: "D", mode: "000000", blob: null, src: []string{foo}, path: "foo", tree: true},
+	}; !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	changes, err = parseChanges("::100644 100644 100644 " + foo + " " + bar + " " + null + " MD\x00bar\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := changes, []change{
+		{status: "MD", mode: "100644", blob: null, src: []string{foo, bar}, path: "bar"},
+	}; !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+	// numstat precedes raw for combined diffs
+	changes, err = parseChanges("1\t1\tbar\x00::100644 100644 100644 " + foo + " " + bar + " " + null + " MM\x00bar\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := changes, []change{
+		{status: "MM", mode: "100644", blob: null, src: []string{foo, bar}, path: "bar", stat: true},
+	}; !reflect.DeepEqual(g, e) {
+		t.Errorf("expected %v, got %v", e, g)
+	}
+
+	for _, l := range []string{
+		"foo\x00",
+		"1\t1\x00",
+		":100644 100644 M\x00foo\x00",
+		":000000 100644 " + null + " " + foo + " A\x00",
 	} {
-		if mtime := stat(tt.path); mtime != tt.mtime {
-			t.Errorf("%v: expected %v, got %v", tt.path, tt.mtime, mtime)
+		if _, err := parseChanges(l); err == nil {
+			t.Errorf("expected error: %q", l)
+		}
+	}
+}
+
+func TestParseStatus(t *testing.T) {
+	const sha1 = "0123456789abcdef0123456789abcdef01234567"
+	paths := map[string]string{
+		"foo":       "foo",
+		"foo bar":   "foo bar",
+		"baz (qux)": "baz",
+	}
+	for _, tt := range []struct {
+		s string
+		c byte
+		p string
+	}{
+		{" " + sha1 + " foo (heads/master)", ' ', "foo"},
+		{"+" + sha1 + " foo bar (v1.0-1-g0123456)", '+', "foo bar"},
+		{"-" + sha1 + " foo bar", '-', "foo bar"},
+		{"U" + sha1 + " baz (qux)", 'U', "baz (qux)"},
+		{" " + sha1 + " baz (qux) (heads/master)", ' ', "baz (qux)"},
+		{" " + sha1 + " quux (heads/master)", ' ', "quux"},
+		{" " + sha1 + " quux", ' ', "quux"},
+	} {
+		c, p := parseStatus(tt.s, paths)
+		if c != tt.c || p != tt.p {
+			t.Errorf("parseStatus(%q) = %q, %q, expected %q, %q", tt.s, c, p, tt.c, tt.p)
 		}
 	}
 }
@@ -609,6 +3088,10 @@ func mv(oldpath, newpath string) error {
 	return exec.Command("git", "mv", oldpath, newpath).Run()
 }
 
+func rm(name string) error {
+	return exec.Command("git", "rm", "-q", name).Run()
+}
+
 func addSubmodule(repo, path string) error {
 	return exec.Command("git", "submodule", "add", repo, path).Run()
 }
@@ -641,6 +3124,17 @@ func stat(path string) string {
 	return fi.ModTime().Format(iso8601)
 }
 
+func statIndex(path string) string {
+	out, _ := exec.Command("git", "ls-files", "--debug", "--", path).Output()
+	for l := range strings.Lines(string(out)) {
+		if s, ok := strings.CutPrefix(strings.TrimSpace(l), "mtime: "); ok {
+			sec, _ := strconv.ParseInt(s[:strings.IndexByte(s, ':')], 10, 64)
+			return time.Unix(sec, 0).Format(iso8601)
+		}
+	}
+	return ""
+}
+
 func touch(s ...string) error {
 	return os.WriteFile(filepath.Join(s...), []byte{}, 0o666)
 }